@@ -48,6 +48,8 @@ func main() {
 	seedNode := flag.String("seed", "", "seed node address")
 	g := flag.String("genesis", "", "path to the genesis block file")
 	rpcAddr := flag.String("rpc-addr", ":12001", "rpc address used to serve wallet RPC calls")
+	drandURL := flag.String("drand-url", "", "drand HTTP API base URL, enables mixing an external randomness beacon into committee selection; leave empty to disable")
+	drandChainInfo := flag.String("drand-chain-info", "", "path to the drand chain-info.json for -drand-url")
 	flag.Parse()
 
 	if *profileDur > 0 {
@@ -97,6 +99,21 @@ func main() {
 	n := createNode(credential, genesis, server, cfg)
 	server.SetSender(n)
 	server.SetStater(n.Chain())
+
+	if *drandURL != "" {
+		info, err := ioutil.ReadFile(*drandChainInfo)
+		if err != nil {
+			panic(err)
+		}
+
+		networks := consensus.NewBeaconNetworks()
+		beacon, err := consensus.NewDrandBeacon(*drandURL, info, networks)
+		if err != nil {
+			panic(err)
+		}
+
+		n.Chain().RandomBeacon.SetExternalBeacon(beacon, networks)
+	}
 	err = server.Start(*rpcAddr)
 	if err != nil {
 		log15.Warn("can not start wallet service", "err", err)
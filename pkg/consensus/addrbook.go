@@ -0,0 +1,270 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAttempts is how many failed dial attempts an address tolerates
+	// before AddrBook forgets it entirely.
+	maxAttempts = 10
+	// pexSampleSize is how many addresses RequestAddrs returns.
+	pexSampleSize = 30
+	// oldBucketBias is how often PickAddress prefers the "old" (known
+	// good) bucket when the node already has plenty of peers, vs.
+	// favoring "new" addresses to diversify its peer set.
+	oldBucketBias = 0.7
+)
+
+// knownAddr is a single address tracked by the AddrBook.
+type knownAddr struct {
+	Addr        string
+	Src         string
+	Attempts    int
+	LastAttempt time.Time
+	LastSuccess time.Time
+}
+
+// addrBookData is the gob-serializable snapshot of an AddrBook.
+type addrBookData struct {
+	New map[string]*knownAddr
+	Old map[string]*knownAddr
+}
+
+// AddrBook persists known peer addresses to disk, split into a "new"
+// bucket (addresses heard about but never successfully dialed) and an
+// "old" bucket (addresses that have been successfully connected to at
+// least once). Addresses are keyed by a hash of (addr, source group)
+// so that a single malicious or buggy source can't flood the book with
+// entries for the same address.
+type AddrBook struct {
+	path string
+
+	mu  sync.Mutex
+	new map[string]*knownAddr
+	old map[string]*knownAddr
+}
+
+// NewAddrBook loads an AddrBook from path if it exists, or creates an
+// empty one.
+func NewAddrBook(path string) *AddrBook {
+	b := &AddrBook{
+		path: path,
+		new:  make(map[string]*knownAddr),
+		old:  make(map[string]*knownAddr),
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return b
+	}
+
+	var data addrBookData
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&data); err != nil {
+		return b
+	}
+
+	if data.New != nil {
+		b.new = data.New
+	}
+	if data.Old != nil {
+		b.old = data.Old
+	}
+	return b
+}
+
+// Save persists the AddrBook to its configured path.
+func (b *AddrBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var buf bytes.Buffer
+	data := addrBookData{New: b.new, Old: b.old}
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(b.path, buf.Bytes(), 0644)
+}
+
+// bucketKey groups entries so that a single source can't flood a
+// bucket with many addresses that are all really one source's doing.
+func bucketKey(addr, src string) string {
+	return fmt.Sprintf("%x", hash([]byte(addr+"|"+src)))
+}
+
+// AddAddress records that src told us about addr. It rejects
+// unroutable (private/loopback/unspecified) addresses outright, and is
+// a no-op if the address is already known.
+func (b *AddrBook) AddAddress(addr, src string) bool {
+	if !isRoutable(addr) {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := bucketKey(addr, src)
+	if _, ok := b.old[key]; ok {
+		return false
+	}
+	if _, ok := b.new[key]; ok {
+		return false
+	}
+
+	b.new[key] = &knownAddr{Addr: addr, Src: src}
+	return true
+}
+
+// MarkAttempt records the outcome of a dial attempt to addr. A
+// successful attempt promotes the address to the old bucket; a
+// failure increments its attempt count, and the address is forgotten
+// once it exceeds maxAttempts.
+func (b *AddrBook) MarkAttempt(addr string, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, ka := range b.new {
+		if ka.Addr != addr {
+			continue
+		}
+
+		ka.LastAttempt = time.Now()
+		if ok {
+			ka.LastSuccess = time.Now()
+			delete(b.new, key)
+			b.old[key] = ka
+			return
+		}
+
+		ka.Attempts++
+		if ka.Attempts >= maxAttempts {
+			delete(b.new, key)
+		}
+		return
+	}
+
+	for key, ka := range b.old {
+		if ka.Addr != addr {
+			continue
+		}
+
+		ka.LastAttempt = time.Now()
+		if ok {
+			ka.LastSuccess = time.Now()
+			return
+		}
+
+		ka.Attempts++
+		if ka.Attempts >= maxAttempts {
+			delete(b.old, key)
+		}
+		return
+	}
+}
+
+// PickAddress returns a random address, biased toward the old bucket
+// when biasOld is true (the node already has plenty of peers and
+// should prefer addresses known to work) and toward the new bucket
+// otherwise (the node has few peers and should diversify).
+func (b *AddrBook) PickAddress(biasOld bool) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	first, second := b.new, b.old
+	if biasOld {
+		first, second = b.old, b.new
+	}
+
+	if len(first) > 0 && rand.Float64() < oldBucketBias {
+		return randomAddr(first)
+	}
+	if len(second) > 0 {
+		return randomAddr(second)
+	}
+	if len(first) > 0 {
+		return randomAddr(first)
+	}
+
+	return "", false
+}
+
+func randomAddr(m map[string]*knownAddr) (string, bool) {
+	if len(m) == 0 {
+		return "", false
+	}
+
+	i := rand.Intn(len(m))
+	for _, ka := range m {
+		if i == 0 {
+			return ka.Addr, true
+		}
+		i--
+	}
+
+	return "", false
+}
+
+// Sample returns up to n addresses drawn across both buckets, for
+// responding to a peer's RequestAddrs.
+func (b *AddrBook) Sample(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	all := make([]string, 0, len(b.new)+len(b.old))
+	for _, ka := range b.new {
+		all = append(all, ka.Addr)
+	}
+	for _, ka := range b.old {
+		all = append(all, ka.Addr)
+	}
+
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// isRoutable reports whether addr (host:port) is a plausible public
+// address, rejecting loopback, private and unspecified ranges that a
+// malicious peer could use to pollute the address book with addresses
+// nobody else can dial.
+func isRoutable(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.TrimSpace(host)
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Not a literal IP (e.g. a DNS name); accept it, the dial
+		// itself will fail later if it's bogus.
+		return host != ""
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil && isPrivateIPv4(ip4) {
+		return false
+	}
+
+	return true
+}
+
+func isPrivateIPv4(ip net.IP) bool {
+	return ip[0] == 10 ||
+		(ip[0] == 172 && ip[1]&0xf0 == 16) ||
+		(ip[0] == 192 && ip[1] == 168)
+}
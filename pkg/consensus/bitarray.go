@@ -0,0 +1,268 @@
+package consensus
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// BitArray is a thread-safe bit array used to track, per peer, which
+// parts of a PartSet have already been seen from or sent to that
+// neighbor. The zero value is not usable; use NewBitArray.
+type BitArray struct {
+	mu   sync.Mutex
+	bits int
+	elem []uint64
+}
+
+// bitArrayRLP is the wire representation of a BitArray: the number of
+// bits it logically holds, and the backing words.
+type bitArrayRLP struct {
+	Bits int
+	Elem []uint64
+}
+
+// NewBitArray creates a BitArray able to hold the given number of
+// bits, all initially unset.
+func NewBitArray(bits int) *BitArray {
+	if bits <= 0 {
+		return nil
+	}
+
+	return &BitArray{
+		bits: bits,
+		elem: make([]uint64, numWords(bits)),
+	}
+}
+
+func numWords(bits int) int {
+	return (bits + 63) / 64
+}
+
+// Size returns the number of bits the array holds.
+func (b *BitArray) Size() int {
+	if b == nil {
+		return 0
+	}
+
+	return b.bits
+}
+
+// GetIndex reports whether the bit at i is set.
+func (b *BitArray) GetIndex(i int) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.getIndex(i)
+}
+
+func (b *BitArray) getIndex(i int) bool {
+	if i < 0 || i >= b.bits {
+		return false
+	}
+
+	return b.elem[i/64]&(uint64(1)<<uint(i%64)) > 0
+}
+
+// SetIndex sets the bit at i to v, reporting whether i was in range.
+func (b *BitArray) SetIndex(i int, v bool) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if i < 0 || i >= b.bits {
+		return false
+	}
+
+	if v {
+		b.elem[i/64] |= uint64(1) << uint(i%64)
+	} else {
+		b.elem[i/64] &^= uint64(1) << uint(i%64)
+	}
+
+	return true
+}
+
+// Copy returns an independent copy of b.
+func (b *BitArray) Copy() *BitArray {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make([]uint64, len(b.elem))
+	copy(c, b.elem)
+	return &BitArray{bits: b.bits, elem: c}
+}
+
+// Sub returns the bits that are set in b but not in o: the parts b has
+// that o is still missing. The two arrays must be the same size.
+func (b *BitArray) Sub(o *BitArray) *BitArray {
+	if b == nil || o == nil || b.bits != o.bits {
+		return nil
+	}
+
+	b.mu.Lock()
+	o.mu.Lock()
+	defer b.mu.Unlock()
+	defer o.mu.Unlock()
+
+	r := NewBitArray(b.bits)
+	for i := 0; i < len(r.elem) && i < len(b.elem) && i < len(o.elem); i++ {
+		r.elem[i] = b.elem[i] &^ o.elem[i]
+	}
+	return r
+}
+
+// Update sets b to the union of b and o, recording every part o
+// reports having. The two arrays must be the same size.
+func (b *BitArray) Update(o *BitArray) {
+	if b == nil || o == nil || b.bits != o.bits {
+		return
+	}
+
+	b.mu.Lock()
+	o.mu.Lock()
+	defer b.mu.Unlock()
+	defer o.mu.Unlock()
+
+	for i := 0; i < len(b.elem) && i < len(o.elem); i++ {
+		b.elem[i] |= o.elem[i]
+	}
+}
+
+// IsFull reports whether every bit is set.
+func (b *BitArray) IsFull() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := 0; i < b.bits; i++ {
+		if !b.getIndex(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// PickRandom returns the index of a random unset bit, and true if one
+// was found. Used to pick which missing part to request next without
+// every peer requesting the same part from the same neighbor.
+func (b *BitArray) PickRandom() (int, bool) {
+	if b == nil {
+		return 0, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var candidates []int
+	for i := 0; i < b.bits; i++ {
+		if !b.getIndex(i) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+// PickRandomSet returns the index of a random set bit, and true if one
+// was found. Used to pick which part a peer has advertised to request
+// from it, the complement of PickRandom.
+func (b *BitArray) PickRandomSet() (int, bool) {
+	if b == nil {
+		return 0, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var candidates []int
+	for i := 0; i < b.bits; i++ {
+		if b.getIndex(i) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+// String renders the bit array as a string of '1' and 'x' characters,
+// useful for debug logging.
+func (b *BitArray) String() string {
+	if b == nil {
+		return "nil-BitArray"
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var sb strings.Builder
+	for i := 0; i < b.bits; i++ {
+		if b.getIndex(i) {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('x')
+		}
+	}
+	return fmt.Sprintf("BA{%s}", sb.String())
+}
+
+// EncodeRLP implements rlp.Encoder.
+func (b *BitArray) EncodeRLP(w io.Writer) error {
+	if b == nil {
+		return rlp.Encode(w, bitArrayRLP{})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return rlp.Encode(w, bitArrayRLP{Bits: b.bits, Elem: b.elem})
+}
+
+// DecodeRLP implements rlp.Decoder. wire comes straight off the wire
+// from a peer's HasParts advertisement, so Bits and Elem are validated
+// against each other before being accepted: an Elem shorter than Bits
+// calls for would otherwise let Update/Sub index it out of range once
+// this BitArray is paired against a longer one of the same Bits.
+func (b *BitArray) DecodeRLP(s *rlp.Stream) error {
+	var wire bitArrayRLP
+	if err := s.Decode(&wire); err != nil {
+		return err
+	}
+
+	if wire.Bits < 0 || wire.Bits > maxPartsPerBlock {
+		return fmt.Errorf("bitarray: decoded Bits %d outside valid range [0, %d]", wire.Bits, maxPartsPerBlock)
+	}
+	if len(wire.Elem) != numWords(wire.Bits) {
+		return fmt.Errorf("bitarray: decoded Elem has %d words, want %d for Bits %d", len(wire.Elem), numWords(wire.Bits), wire.Bits)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bits = wire.Bits
+	b.elem = wire.Elem
+	return nil
+}
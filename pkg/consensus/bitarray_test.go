@@ -0,0 +1,104 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitArraySetGetIndex(t *testing.T) {
+	b := NewBitArray(10)
+	assert.False(t, b.GetIndex(3))
+	assert.True(t, b.SetIndex(3, true))
+	assert.True(t, b.GetIndex(3))
+	assert.False(t, b.SetIndex(10, true), "out of range index should report false")
+	assert.False(t, b.SetIndex(-1, true))
+}
+
+func TestBitArraySub(t *testing.T) {
+	a := NewBitArray(4)
+	a.SetIndex(0, true)
+	a.SetIndex(1, true)
+
+	b := NewBitArray(4)
+	b.SetIndex(1, true)
+
+	d := a.Sub(b)
+	assert.True(t, d.GetIndex(0))
+	assert.False(t, d.GetIndex(1))
+	assert.False(t, d.GetIndex(2))
+}
+
+func TestBitArrayUpdate(t *testing.T) {
+	a := NewBitArray(4)
+	a.SetIndex(0, true)
+
+	b := NewBitArray(4)
+	b.SetIndex(2, true)
+
+	a.Update(b)
+	assert.True(t, a.GetIndex(0))
+	assert.True(t, a.GetIndex(2))
+	assert.False(t, a.GetIndex(1))
+}
+
+func TestBitArrayIsFull(t *testing.T) {
+	a := NewBitArray(2)
+	assert.False(t, a.IsFull())
+	a.SetIndex(0, true)
+	assert.False(t, a.IsFull())
+	a.SetIndex(1, true)
+	assert.True(t, a.IsFull())
+}
+
+func TestBitArrayPickRandom(t *testing.T) {
+	a := NewBitArray(3)
+	a.SetIndex(0, true)
+	a.SetIndex(1, true)
+
+	idx, ok := a.PickRandom()
+	assert.True(t, ok)
+	assert.Equal(t, 2, idx)
+
+	a.SetIndex(2, true)
+	_, ok = a.PickRandom()
+	assert.False(t, ok, "a full array has nothing left to pick")
+}
+
+func TestBitArrayPickRandomSet(t *testing.T) {
+	a := NewBitArray(3)
+	a.SetIndex(1, true)
+
+	idx, ok := a.PickRandomSet()
+	assert.True(t, ok)
+	assert.Equal(t, 1, idx)
+
+	a.SetIndex(1, false)
+	_, ok = a.PickRandomSet()
+	assert.False(t, ok, "an empty array has nothing to pick")
+}
+
+func TestBitArrayDecodeRLPRejectsMismatchedElemLength(t *testing.T) {
+	wire, err := rlp.EncodeToBytes(bitArrayRLP{Bits: 128, Elem: []uint64{1}})
+	assert.NoError(t, err)
+
+	var b BitArray
+	err = rlp.DecodeBytes(wire, &b)
+	assert.Error(t, err, "Elem too short for Bits must be rejected, not indexed out of range later")
+}
+
+func TestBitArrayUpdateToleratesShortElem(t *testing.T) {
+	a := NewBitArray(128)
+	short := &BitArray{bits: 128, elem: []uint64{1}}
+
+	assert.NotPanics(t, func() { a.Update(short) })
+	assert.True(t, a.GetIndex(0))
+}
+
+func TestBitArrayCopyIsIndependent(t *testing.T) {
+	a := NewBitArray(2)
+	c := a.Copy()
+	a.SetIndex(0, true)
+	assert.False(t, c.GetIndex(0), "mutating the original must not affect the copy")
+}
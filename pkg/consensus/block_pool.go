@@ -0,0 +1,501 @@
+package consensus
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// defaultMinRecvRate is the minimum acceptable exponential moving
+	// average receive rate (bytes/sec) for a sync peer before it is
+	// dropped.
+	defaultMinRecvRate = 7500
+	// defaultPeerTimeout is how long BlockPool waits for a requested
+	// range to arrive before reassigning it to another peer.
+	defaultPeerTimeout = 15 * time.Second
+	// defaultWindow bounds how many outstanding requests BlockPool
+	// will keep in flight against a single peer at once.
+	defaultWindow = 4
+	// rangeSize is the number of rounds requested per GetData/Sync
+	// call.
+	rangeSize = 32
+	// maxHeightDiff caps how far ahead of our current height a peer's
+	// self-reported height may be before we refuse to trust it. This
+	// stops a malicious peer from claiming a far-future height to
+	// monopolize the pool's attention.
+	maxHeightDiff = 1000000
+)
+
+// blockRange is a disjoint, half-open range of rounds [Start, End) that
+// has been assigned to a peer to fetch.
+type blockRange struct {
+	start int
+	end   int
+}
+
+// blockRequest records an outstanding request for a blockRange against
+// a specific peer, so the pool can detect timeouts and reassign work.
+type blockRequest struct {
+	peer string
+	rng  blockRange
+	sent time.Time
+}
+
+// blockResult is what a completed request yields: either the requested
+// blocks and random beacon signatures, or an error explaining why the
+// peer should be penalized.
+type blockResult struct {
+	peer   string
+	rng    blockRange
+	rb     []*RandBeaconSig
+	bs     []*Block
+	nBytes int
+	err    error
+}
+
+// emaRate tracks an exponential moving average of a peer's
+// byte-receive rate, used to detect and drop peers that are too slow
+// to be useful.
+type emaRate struct {
+	rate float64 // bytes/sec
+	init bool
+}
+
+// alpha is the EMA smoothing factor: higher weighs recent samples more.
+const emaAlpha = 0.3
+
+func (e *emaRate) update(nBytes int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	sample := float64(nBytes) / d.Seconds()
+	if !e.init {
+		e.rate = sample
+		e.init = true
+		return
+	}
+
+	e.rate = emaAlpha*sample + (1-emaAlpha)*e.rate
+}
+
+// BlockPool synchronizes the random beacon history and the finalized
+// chain from multiple peers in parallel, instead of serializing the
+// whole catch-up behind a single seed peer.
+//
+// It splits the range between the node's current height and the
+// highest height reported by its peers into fixed-size chunks, assigns
+// each chunk to a peer subject to a bounded in-flight window per peer,
+// and reassigns chunks whose peer times out or turns out to be too
+// slow. Blocks are buffered as they arrive out of order and only
+// handed to chain.addBlock once they form a contiguous run starting at
+// the next expected round.
+type BlockPool struct {
+	chain *Chain
+	v     *validator
+
+	mu          sync.Mutex
+	heights     map[string]int
+	inFlight    map[string]map[blockRange]*blockRequest
+	rates       map[string]*emaRate
+	dropped     map[string]bool
+	minRecvRate float64
+	peerTimeout time.Duration
+	window      int
+
+	rbBuf   map[int]*RandBeaconSig
+	bBuf    map[int]*Block
+	bWeight map[int]int
+
+	// assignedEnd is the high-water mark of rounds already carved off
+	// into a range and handed to some peer, tracked separately from
+	// ourHeight so that a peer gaining spare window before ourHeight
+	// advances (e.g. one freshly added via PEX or the dial loop) can't
+	// be handed a range that duplicates one already in flight
+	// elsewhere. pending holds ranges that failed or timed out and
+	// must be reassigned before any new range is carved off
+	// assignedEnd.
+	assignedEnd int
+	pending     []blockRange
+
+	// requestsCh and errorsCh let tests observe the pool's scheduling
+	// decisions without standing up real peer sockets.
+	requestsCh chan blockRange
+	errorsCh   chan error
+	results    chan blockResult
+}
+
+// NewBlockPool creates a BlockPool for the given chain using the
+// default rate threshold, timeout and in-flight window.
+func NewBlockPool(chain *Chain, v *validator) *BlockPool {
+	return &BlockPool{
+		chain:       chain,
+		v:           v,
+		heights:     make(map[string]int),
+		inFlight:    make(map[string]map[blockRange]*blockRequest),
+		rates:       make(map[string]*emaRate),
+		dropped:     make(map[string]bool),
+		minRecvRate: defaultMinRecvRate,
+		peerTimeout: defaultPeerTimeout,
+		window:      defaultWindow,
+		rbBuf:       make(map[int]*RandBeaconSig),
+		bBuf:        make(map[int]*Block),
+		bWeight:     make(map[int]int),
+		requestsCh:  make(chan blockRange, 64),
+		errorsCh:    make(chan error, 64),
+		results:     make(chan blockResult, 64),
+	}
+}
+
+// SetPeerHeight records a peer's self-reported height, learned from the
+// extended Ping handshake. It is ignored if the height is implausibly
+// far ahead of any height already seen, to avoid a malicious far-future
+// peer skewing the target height.
+func (p *BlockPool) SetPeerHeight(addr string, height int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if height-p.ourHeight() > maxHeightDiff {
+		log.Printf("ignoring implausible height %d reported by %s\n", height, addr)
+		return
+	}
+
+	p.heights[addr] = height
+}
+
+func (p *BlockPool) ourHeight() int {
+	return len(p.chain.RandomBeacon.History())
+}
+
+// targetHeight returns the highest height reported by any peer.
+func (p *BlockPool) targetHeight() int {
+	t := p.ourHeight()
+	for _, h := range p.heights {
+		if h > t {
+			t = h
+		}
+	}
+	return t
+}
+
+// Sync drives the node from its current height to the highest height
+// reported by peers, issuing requests for disjoint ranges in parallel
+// across peers and gating each peer to at most p.window outstanding
+// requests. It blocks until the node is caught up or every known peer
+// has been dropped.
+func (p *BlockPool) Sync(peers func() map[string]Peer) error {
+	for {
+		p.mu.Lock()
+		next := p.ourHeight()
+		target := p.targetHeight()
+		if next >= target {
+			p.mu.Unlock()
+			return nil
+		}
+
+		if p.assignedEnd < next {
+			p.assignedEnd = next
+		}
+
+		assigned := p.assignRanges(target, peers())
+		p.mu.Unlock()
+
+		if assigned == 0 && !p.anyInFlight() {
+			return fmt.Errorf("block pool: no peers left to sync from, stuck at height %d of %d", next, target)
+		}
+
+		select {
+		case res := <-p.resultCh():
+			p.handleResult(res)
+		case <-time.After(p.peerTimeout):
+			p.reapTimeouts()
+		}
+	}
+}
+
+// assignRanges hands out new disjoint ranges to peers that have spare
+// capacity in their in-flight window. It must be called with p.mu held.
+func (p *BlockPool) assignRanges(target int, live map[string]Peer) int {
+	assigned := 0
+	for addr, peer := range live {
+		if p.dropped[addr] {
+			continue
+		}
+
+		for len(p.inFlight[addr]) < p.window {
+			rng, ok := p.nextRange(target)
+			if !ok {
+				break
+			}
+
+			if p.inFlight[addr] == nil {
+				p.inFlight[addr] = make(map[blockRange]*blockRequest)
+			}
+			p.inFlight[addr][rng] = &blockRequest{peer: addr, rng: rng, sent: p.now()}
+			assigned++
+
+			go p.fetch(addr, peer, rng)
+
+			select {
+			case p.requestsCh <- rng:
+			default:
+			}
+		}
+	}
+
+	return assigned
+}
+
+// nextRange returns the next disjoint range to assign: a previously
+// failed or timed-out range if one is pending reassignment, otherwise
+// a fresh range carved off assignedEnd, the high-water mark of rounds
+// already handed to some peer. It must be called with p.mu held.
+func (p *BlockPool) nextRange(target int) (blockRange, bool) {
+	if len(p.pending) > 0 {
+		rng := p.pending[0]
+		p.pending = p.pending[1:]
+		return rng, true
+	}
+
+	if p.assignedEnd >= target {
+		return blockRange{}, false
+	}
+
+	end := p.assignedEnd + rangeSize
+	if end > target {
+		end = target
+	}
+
+	rng := blockRange{start: p.assignedEnd, end: end}
+	p.assignedEnd = end
+	return rng, true
+}
+
+// now is a seam so tests can fake time; overridden in tests.
+func (p *BlockPool) now() time.Time {
+	return time.Now()
+}
+
+func (p *BlockPool) anyInFlight() bool {
+	for _, reqs := range p.inFlight {
+		if len(reqs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *BlockPool) resultCh() <-chan blockResult {
+	return p.results
+}
+
+func (p *BlockPool) fetch(addr string, peer Peer, rng blockRange) {
+	rb, bs, err := peer.Sync(rng.start, rng.end)
+	res := blockResult{peer: addr, rng: rng}
+	if err != nil {
+		res.err = err
+		p.results <- res
+		return
+	}
+
+	n := 0
+	for _, s := range rb {
+		if b, err := rlp.EncodeToBytes(s); err == nil {
+			n += len(b)
+		}
+	}
+	for _, b := range bs {
+		if raw, err := rlp.EncodeToBytes(b); err == nil {
+			n += len(raw)
+		}
+	}
+	res.rb = rb
+	res.bs = bs
+	res.nBytes = n
+	p.results <- res
+}
+
+func (p *BlockPool) handleResult(res blockResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	req, ok := p.inFlight[res.peer][res.rng]
+	if !ok {
+		// Already reassigned due to timeout; ignore the late result.
+		return
+	}
+	delete(p.inFlight[res.peer], res.rng)
+
+	if res.err != nil {
+		select {
+		case p.errorsCh <- res.err:
+		default:
+		}
+		p.dropped[res.peer] = true
+		p.pending = append(p.pending, res.rng)
+		return
+	}
+
+	elapsed := p.now().Sub(req.sent)
+	rate, ok := p.rates[res.peer]
+	if !ok {
+		rate = &emaRate{}
+		p.rates[res.peer] = rate
+	}
+	rate.update(res.nBytes, elapsed)
+	if rate.init && rate.rate < p.minRecvRate {
+		log.Printf("dropping sync peer %s: recv rate %.0f B/s below minimum %.0f B/s\n", res.peer, rate.rate, p.minRecvRate)
+		p.dropped[res.peer] = true
+	}
+
+	for _, s := range res.rb {
+		p.rbBuf[s.Round] = s
+	}
+	for _, b := range res.bs {
+		p.bBuf[b.Round] = b
+		// A weight cached by a live ReceiveBlock was computed for
+		// whatever block occupied this round before; it must not be
+		// paired with the block this sync response just overwrote it
+		// with, so drainContiguous re-validates it.
+		delete(p.bWeight, b.Round)
+	}
+
+	p.drainContiguous()
+}
+
+// drainContiguous hands buffered blocks and random beacon signatures to
+// the chain in strict ascending round order, stopping at the first
+// gap. When an external beacon is configured, a round's signature is
+// held back until that round's block is buffered too: the block is
+// the only place a verified BeaconEntry is available, and every honest
+// node must fold the same one into committee derivation, so the
+// signature can't be processed on its own. It must be called with
+// p.mu held.
+func (p *BlockPool) drainContiguous() {
+	for {
+		round := len(p.chain.RandomBeacon.History())
+		s, ok := p.rbBuf[round]
+		if !ok {
+			return
+		}
+
+		var entries []BeaconEntry
+		if p.chain.RandomBeacon.ExternalConfigured() {
+			b, ok := p.bBuf[round]
+			if !ok {
+				return
+			}
+
+			prev, ok := p.chain.Block(b.PrevBlock)
+			if !ok {
+				log.Printf("block pool: missing parent block %x during sync\n", b.PrevBlock)
+				return
+			}
+
+			if err := p.chain.RandomBeacon.VerifyBeaconEntries(prev.Round, b.Round, prev.BeaconEntries, b.BeaconEntries); err != nil {
+				log.Println(err)
+				delete(p.rbBuf, round)
+				delete(p.bBuf, round)
+				delete(p.bWeight, round)
+				return
+			}
+			entries = b.BeaconEntries
+		}
+
+		if err := p.chain.RandomBeacon.RecvRandBeaconSig(s, entries); err != nil {
+			log.Println(err)
+			return
+		}
+		delete(p.rbBuf, round)
+
+		b, ok := p.bBuf[round]
+		if !ok {
+			continue
+		}
+
+		weight, ok := p.bWeight[round]
+		if !ok {
+			var valid bool
+			weight, valid = p.v.ValidateBlock(b)
+			if !valid {
+				log.Println("block pool: ValidateBlock failed during sync")
+				delete(p.bBuf, round)
+				continue
+			}
+		}
+
+		if err := p.chain.addBlock(b, weight); err != nil {
+			log.Println(err)
+			return
+		}
+		delete(p.bBuf, round)
+		delete(p.bWeight, round)
+	}
+}
+
+// ReceiveRandBeaconSig buffers a random beacon signature received
+// outside of Sync (e.g. over gossip) and drains any rounds that are
+// now contiguous. It applies the same ordering guarantee Sync relies
+// on: see drainContiguous.
+func (p *BlockPool) ReceiveRandBeaconSig(s *RandBeaconSig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rbBuf[s.Round] = s
+	p.drainContiguous()
+}
+
+// ReceiveBlock buffers a block already validated by the caller,
+// recording its weight so drainContiguous doesn't re-validate it, and
+// drains any rounds that are now contiguous.
+func (p *BlockPool) ReceiveBlock(b *Block, weight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bBuf[b.Round] = b
+	p.bWeight[b.Round] = weight
+	p.drainContiguous()
+}
+
+// DropPeer removes addr from consideration entirely: it is marked
+// dropped and its height is forgotten, and its in-flight requests are
+// queued for reassignment to another peer rather than discarded. Used
+// when Networking evicts a peer for bad behavior, so the pool doesn't
+// keep waiting on requests that will never be answered.
+func (p *BlockPool) DropPeer(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dropped[addr] = true
+	delete(p.heights, addr)
+	for rng := range p.inFlight[addr] {
+		p.pending = append(p.pending, rng)
+	}
+	delete(p.inFlight, addr)
+}
+
+// reapTimeouts reassigns any request that has been outstanding longer
+// than p.peerTimeout, crediting nothing to the offending peer but also
+// not outright dropping it, since the timeout may be transient network
+// latency rather than malice.
+func (p *BlockPool) reapTimeouts() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for addr, reqs := range p.inFlight {
+		for rng, req := range reqs {
+			if now.Sub(req.sent) < p.peerTimeout {
+				continue
+			}
+
+			log.Printf("sync request to %s for rounds [%d, %d) timed out, reassigning\n", addr, rng.start, rng.end)
+			delete(reqs, rng)
+			p.pending = append(p.pending, rng)
+		}
+	}
+}
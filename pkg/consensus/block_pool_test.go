@@ -0,0 +1,131 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePeer is a no-op Peer used to exercise BlockPool's scheduling
+// decisions without a real socket.
+type fakePeer struct {
+	syncFn func(start, end int) ([]*RandBeaconSig, []*Block, error)
+}
+
+func (f *fakePeer) Txn(txn []byte) error                                          { return nil }
+func (f *fakePeer) SysTxn(s *SysTxn) error                                        { return nil }
+func (f *fakePeer) RandBeaconSigShare(sender string, r *RandBeaconSigShare) error { return nil }
+func (f *fakePeer) RandBeaconSig(sender string, r *RandBeaconSig) error           { return nil }
+func (f *fakePeer) Block(sender string, b *Block) error                           { return nil }
+func (f *fakePeer) BlockProposal(sender string, b *BlockProposal) error           { return nil }
+func (f *fakePeer) NotarizationShare(sender string, n *NtShare) error             { return nil }
+func (f *fakePeer) Inventory(sender string, items []ItemID) error                 { return nil }
+func (f *fakePeer) GetData(requester string, items []ItemID) error                { return nil }
+func (f *fakePeer) HasParts(sender string, h Hash, header PartSetHeader, bits *BitArray) error {
+	return nil
+}
+func (f *fakePeer) BlockPart(sender string, h Hash, index int, proof []Hash, data []byte) error {
+	return nil
+}
+func (f *fakePeer) Peers() ([]string, error)                        { return nil, nil }
+func (f *fakePeer) UpdatePeers(sender string, addrs []string) error { return nil }
+func (f *fakePeer) RequestAddrs() ([]string, error)                 { return nil, nil }
+func (f *fakePeer) Ping(ctx context.Context) (int, error)           { return 0, nil }
+func (f *fakePeer) Sync(start, end int) ([]*RandBeaconSig, []*Block, error) {
+	if f.syncFn != nil {
+		return f.syncFn(start, end)
+	}
+	return nil, nil, nil
+}
+
+func newTestBlockPool() *BlockPool {
+	return &BlockPool{
+		heights:     make(map[string]int),
+		inFlight:    make(map[string]map[blockRange]*blockRequest),
+		rates:       make(map[string]*emaRate),
+		dropped:     make(map[string]bool),
+		minRecvRate: defaultMinRecvRate,
+		peerTimeout: defaultPeerTimeout,
+		window:      defaultWindow,
+		rbBuf:       make(map[int]*RandBeaconSig),
+		bBuf:        make(map[int]*Block),
+		requestsCh:  make(chan blockRange, 64),
+		errorsCh:    make(chan error, 64),
+		results:     make(chan blockResult, 64),
+	}
+}
+
+// TestBlockPoolAssignRangesNoDuplicates guards against a regression
+// where a peer gaining spare window before ourHeight advanced (e.g.
+// one freshly added via PEX) could be handed a range that duplicated
+// one already in flight to another peer.
+func TestBlockPoolAssignRangesNoDuplicates(t *testing.T) {
+	p := newTestBlockPool()
+	a := &fakePeer{}
+
+	// First peer takes its full window.
+	assigned := p.assignRanges(1000, map[string]Peer{"a": a})
+	assert.Equal(t, defaultWindow, assigned)
+
+	// A second peer joining afterwards, before any range has
+	// completed, must not be handed ranges overlapping "a"'s.
+	b := &fakePeer{}
+	p.assignRanges(1000, map[string]Peer{"b": b})
+
+	seen := make(map[blockRange]bool)
+	for _, reqs := range p.inFlight {
+		for rng := range reqs {
+			assert.False(t, seen[rng], "range %v assigned to more than one peer", rng)
+			seen[rng] = true
+		}
+	}
+}
+
+func TestBlockPoolReapTimeoutsRequeues(t *testing.T) {
+	p := newTestBlockPool()
+	p.peerTimeout = time.Millisecond
+	rng := blockRange{start: 0, end: rangeSize}
+	p.inFlight["a"] = map[blockRange]*blockRequest{
+		rng: {peer: "a", rng: rng, sent: time.Now().Add(-time.Hour)},
+	}
+
+	p.reapTimeouts()
+	assert.Empty(t, p.inFlight["a"])
+	assert.Equal(t, []blockRange{rng}, p.pending)
+}
+
+func TestBlockPoolNextRangePrefersPending(t *testing.T) {
+	p := newTestBlockPool()
+	p.assignedEnd = 100
+	pending := blockRange{start: 0, end: rangeSize}
+	p.pending = []blockRange{pending}
+
+	rng, ok := p.nextRange(1000)
+	assert.True(t, ok)
+	assert.Equal(t, pending, rng)
+	assert.Empty(t, p.pending)
+	assert.Equal(t, 100, p.assignedEnd, "assignedEnd must not move for a reassigned range")
+}
+
+func TestBlockPoolDropPeerRequeuesInFlight(t *testing.T) {
+	p := newTestBlockPool()
+	rng := blockRange{start: 0, end: rangeSize}
+	p.inFlight["a"] = map[blockRange]*blockRequest{rng: {peer: "a", rng: rng, sent: time.Now()}}
+
+	p.DropPeer("a")
+	assert.True(t, p.dropped["a"])
+	assert.Equal(t, []blockRange{rng}, p.pending)
+	_, ok := p.inFlight["a"]
+	assert.False(t, ok)
+}
+
+func TestEMARateDropsSlowPeer(t *testing.T) {
+	var rate emaRate
+	for i := 0; i < 5; i++ {
+		rate.update(1000, time.Second) // 1000 B/s, well below the default minimum
+	}
+
+	assert.Less(t, rate.rate, float64(defaultMinRecvRate))
+}
@@ -0,0 +1,451 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// maxTrackedParts bounds how many distinct block hashes ChainMgr keeps
+// PartSet/peerHave bookkeeping for at once. Without a cap, a peer
+// advertising HasParts for arbitrary hashes it has no data for could
+// grow partSets/peerHave without bound; the oldest tracked hash is
+// evicted once the limit is reached.
+const maxTrackedParts = 512
+
+// maxPendingRandBeaconRounds bounds how far ahead of the node's current
+// random beacon round a gossiped RandBeaconSig may sit in the block
+// pool's buffer before its round is contiguous. Without a cap, a peer
+// could send signatures for arbitrary far-future rounds to grow that
+// buffer without bound.
+const maxPendingRandBeaconRounds = 1024
+
+// ChainMgr is the chain-sync reactor. It owns the block pool that
+// catches the node up with its peers, serves and requests blocks,
+// random beacon signatures and block parts, and keeps the per-block
+// PartSet bookkeeping used to gossip blocks without resending data a
+// peer already has. It shares its PeerSet with ConsensusMgr so both
+// reactors agree on which addresses are connected and banned, but
+// doesn't use the set's send queues: sync traffic is already
+// throttled by the block pool's own in-flight window and calls peers
+// directly.
+type ChainMgr struct {
+	net   Network
+	addr  string
+	chain *Chain
+	v     *validator
+	pool  *BlockPool
+	peers *PeerSet
+
+	partMu    sync.Mutex
+	partSets  map[Hash]*PartSet
+	peerHave  map[Hash]map[string]*BitArray
+	partOrder []Hash
+}
+
+// NewChainMgr creates a ChainMgr sharing peers with the rest of the
+// node's reactors.
+func NewChainMgr(net Network, addr string, chain *Chain, v *validator, peers *PeerSet) *ChainMgr {
+	return &ChainMgr{
+		net:      net,
+		addr:     addr,
+		chain:    chain,
+		v:        v,
+		pool:     NewBlockPool(chain, v),
+		peers:    peers,
+		partSets: make(map[Hash]*PartSet),
+		peerHave: make(map[Hash]map[string]*BitArray),
+	}
+}
+
+// trackPart records h as tracked bookkeeping state, evicting the
+// oldest tracked hash once more than maxTrackedParts are held. Must be
+// called with m.partMu held, once per hash the first time either
+// partSets or peerHave gains an entry for it.
+func (m *ChainMgr) trackPart(h Hash) {
+	m.partOrder = append(m.partOrder, h)
+	if len(m.partOrder) <= maxTrackedParts {
+		return
+	}
+
+	evict := m.partOrder[0]
+	m.partOrder = m.partOrder[1:]
+	delete(m.partSets, evict)
+	delete(m.peerHave, evict)
+}
+
+// Broadcast advertises item to every peer. For a BlockItem, rather
+// than fanning out the full block, only the PartSetHeader and the set
+// of parts already held are advertised; recvHasParts drives each
+// receiving peer to pull just the parts it is missing. A peer already
+// known, via peerHave, to hold every part is skipped entirely, so a
+// neighbor that has fully synced a block isn't re-advertised to on
+// every subsequent Broadcast of it.
+func (m *ChainMgr) Broadcast(item ItemID) {
+	if item.T == BlockItem {
+		ps, ok := m.partSetFor(item.Hash)
+		if !ok {
+			log.Printf("ChainMgr.Broadcast: no part set for block %x\n", item.Hash)
+			return
+		}
+
+		for _, addr := range m.peers.List() {
+			m.partMu.Lock()
+			have := m.peerHave[item.Hash][addr]
+			m.partMu.Unlock()
+			if have.IsFull() {
+				continue
+			}
+
+			p, ok := m.peers.Get(addr)
+			if !ok {
+				continue
+			}
+			p := p
+			go func() {
+				p.HasParts(m.addr, item.Hash, ps.Header(), ps.BitArray())
+			}()
+		}
+		return
+	}
+
+	for _, addr := range m.peers.List() {
+		p, ok := m.peers.Get(addr)
+		if !ok {
+			continue
+		}
+		p := p
+		go func() {
+			p.Inventory(m.addr, []ItemID{item})
+		}()
+	}
+}
+
+// partSetFor returns the PartSet for the block with the given hash,
+// building and caching one from the chain's copy of the block the
+// first time it is needed.
+func (m *ChainMgr) partSetFor(h Hash) (*PartSet, bool) {
+	m.partMu.Lock()
+	defer m.partMu.Unlock()
+
+	if ps, ok := m.partSets[h]; ok {
+		return ps, true
+	}
+
+	b, ok := m.chain.Block(h)
+	if !ok {
+		return nil, false
+	}
+
+	body, err := rlp.EncodeToBytes(b)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+
+	ps := NewPartSet(body)
+	m.partSets[h] = ps
+	m.trackPart(h)
+	return ps, true
+}
+
+// recvHasParts handles a peer's PartSetHeader/bitmask advertisement for
+// a block: it records what the sender has, makes sure a local PartSet
+// is being tracked for the block, and pulls a random part the sender
+// has that the node is still missing. header.Total is wire-supplied,
+// so it's bounds-checked before anything is sized by it; a header
+// outside the valid range gets the sender penalized the same way a
+// failed Merkle proof does in recvBlockPart.
+func (m *ChainMgr) recvHasParts(sender string, h Hash, header PartSetHeader, bits *BitArray) {
+	if header.Total < 1 || header.Total > maxPartsPerBlock {
+		log.Printf("recvHasParts: header.Total %d outside valid range [1, %d]\n", header.Total, maxPartsPerBlock)
+		m.peers.StopForError(sender, fmt.Errorf("invalid PartSetHeader.Total: %d", header.Total))
+		return
+	}
+
+	m.partMu.Lock()
+	known, ok := m.peerHave[h][sender]
+	if !ok {
+		known = NewBitArray(header.Total)
+		if m.peerHave[h] == nil {
+			m.peerHave[h] = make(map[string]*BitArray)
+		}
+		m.peerHave[h][sender] = known
+		m.trackPart(h)
+	}
+	known.Update(bits)
+
+	ps, ok := m.partSets[h]
+	if !ok {
+		if _, have := m.chain.Block(h); have {
+			m.partMu.Unlock()
+			return
+		}
+
+		var err error
+		ps, err = NewPartSetFromHeader(header)
+		if err != nil {
+			m.partMu.Unlock()
+			log.Println(err)
+			m.peers.StopForError(sender, err)
+			return
+		}
+		m.partSets[h] = ps
+		m.trackPart(h)
+	}
+	m.partMu.Unlock()
+
+	missing := bits.Sub(ps.BitArray())
+	index, ok := missing.PickRandomSet()
+	if !ok {
+		return
+	}
+
+	p, err := m.peers.FindOrConnect(m.net, sender)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	p.GetData(m.addr, []ItemID{{T: BlockPartItem, Hash: h, Index: index}})
+}
+
+// recvBlockPart handles a single verified part of a block's PartSet.
+// Once every part has arrived, the block is reassembled and handed to
+// recvBlock as if it had arrived whole.
+func (m *ChainMgr) recvBlockPart(sender string, h Hash, index int, proof []Hash, data []byte) {
+	m.partMu.Lock()
+	ps, ok := m.partSets[h]
+	m.partMu.Unlock()
+	if !ok {
+		log.Printf("recvBlockPart: no part set tracked for block %x, dropping part %d\n", h, index)
+		return
+	}
+
+	err := ps.AddPart(&Part{Index: index, Bytes: data, Proof: proof})
+	if err != nil {
+		log.Println(err)
+		m.peers.StopForError(sender, err)
+		return
+	}
+
+	m.peers.MarkGood(sender)
+	if !ps.IsComplete() {
+		return
+	}
+
+	body, err := ps.Bytes()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var b Block
+	if err := rlp.DecodeBytes(body, &b); err != nil {
+		log.Println(err)
+		m.peers.StopForError(sender, errInvalidSig)
+		return
+	}
+
+	go m.recvBlock(sender, &b)
+}
+
+func (m *ChainMgr) recvBlock(sender string, b *Block) {
+	weight, valid := m.v.ValidateBlock(b)
+	if !valid {
+		log.Println("ValidateBlock failed")
+		m.peers.StopForError(sender, errInvalidSig)
+		return
+	}
+
+	// A parent that hasn't arrived yet is routine during gossip and
+	// catch-up, not misbehavior: blocks can reassemble out of order
+	// across peers. Skip the eager BeaconEntries check rather than
+	// penalizing the sender for it; drainContiguous re-verifies entries
+	// against the parent once it is buffered or committed (see
+	// BlockPool.drainContiguous), folding the block in once its parent
+	// shows up.
+	if prev, ok := m.chain.Block(b.PrevBlock); ok {
+		if err := m.chain.RandomBeacon.VerifyBeaconEntries(prev.Round, b.Round, prev.BeaconEntries, b.BeaconEntries); err != nil {
+			log.Println(err)
+			m.peers.StopForError(sender, err)
+			return
+		}
+	} else {
+		log.Printf("recvBlock: missing parent block %x, buffering round %d\n", b.PrevBlock, b.Round)
+	}
+
+	// TODO: make sure received all block's parents and block
+	// proposal before processing this block.
+
+	// Handed to the pool rather than m.chain.addBlock directly: the
+	// pool holds the block back, alongside any already-buffered random
+	// beacon signature for its round, until both have arrived, so
+	// committee derivation never runs ahead of the block carrying the
+	// entries it must fold in.
+	m.pool.ReceiveBlock(b, weight)
+
+	m.peers.MarkGood(sender)
+	go m.Broadcast(ItemID{T: BlockItem, Hash: b.Hash(), ItemRound: b.Round, Ref: b.PrevBlock})
+}
+
+func (m *ChainMgr) recvRandBeaconSig(sender string, r *RandBeaconSig) {
+	if !m.v.ValidateRandBeaconSig(r) {
+		log.Printf("ValidateRandBeaconSig failed, round: %d\n", r.Round)
+		m.peers.StopForError(sender, errInvalidSig)
+		return
+	}
+
+	cur := m.chain.RandomBeacon.Round()
+	if r.Round < cur || r.Round > cur+maxPendingRandBeaconRounds {
+		log.Printf("recvRandBeaconSig: round %d out of range of current round %d\n", r.Round, cur)
+		m.peers.StopForError(sender, errWrongRound)
+		return
+	}
+
+	// Buffered through the pool, alongside Sync's own traffic, rather
+	// than handed to RandomBeacon directly: see recvBlock.
+	m.pool.ReceiveRandBeaconSig(r)
+
+	m.peers.MarkGood(sender)
+	go m.Broadcast(ItemID{T: RandBeaconItem, Hash: r.Hash(), ItemRound: r.Round})
+}
+
+// handleInventory serves the subset of an Inventory message that the
+// chain-sync reactor owns: BlockItem and RandBeaconItem.
+func (m *ChainMgr) handleInventory(sender string, ids []ItemID) {
+	if len(ids) == 0 {
+		return
+	}
+
+	p, err := m.peers.FindOrConnect(m.net, sender)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	round := m.chain.Round()
+	for _, id := range ids {
+		switch id.T {
+		case BlockItem:
+			// TODO: improve logic of what to get, e.g., using id.Ref
+			if _, ok := m.chain.Block(id.Hash); !ok {
+				p.GetData(m.addr, []ItemID{id})
+			}
+		case RandBeaconItem:
+			if id.ItemRound != round {
+				log.Printf("recv random beacon share for round: %d, handling: %d\n", id.ItemRound, round)
+				continue
+			}
+
+			p.GetData(m.addr, []ItemID{id})
+		}
+	}
+}
+
+// getSyncData returns the random beacon signatures and blocks for the
+// half-open round range [start, end). end == 0 means through the
+// node's latest round. start and end come straight off the wire from
+// a peer's Sync request, so they're validated before any slicing:
+// a negative start, or an end before start, returns nil, nil rather
+// than panicking.
+func (m *ChainMgr) getSyncData(start, end int) ([]*RandBeaconSig, []*Block) {
+	if start < 0 || (end > 0 && end < start) {
+		return nil, nil
+	}
+
+	history := m.chain.RandomBeacon.History()
+	if len(history) <= start {
+		return nil, nil
+	}
+
+	if end <= 0 || end > len(history) {
+		end = len(history)
+	}
+
+	blocks := m.chain.FinalizedChain()
+	if len(blocks) <= start {
+		blocks = nil
+	} else {
+		if end > len(blocks) {
+			blocks = blocks[start:]
+		} else {
+			blocks = blocks[start:end]
+		}
+	}
+
+	return history[start:end], blocks
+}
+
+// serveData answers the subset of a GetData request that the
+// chain-sync reactor owns: BlockItem, RandBeaconItem and
+// BlockPartItem.
+func (m *ChainMgr) serveData(requester string, ids []ItemID) {
+	if len(ids) == 0 {
+		return
+	}
+
+	p, err := m.peers.FindOrConnect(m.net, requester)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, id := range ids {
+		switch id.T {
+		case BlockItem:
+			b, ok := m.chain.Block(id.Hash)
+			if !ok {
+				continue
+			}
+			p.Block(m.addr, b)
+		case RandBeaconItem:
+			history := m.chain.RandomBeacon.History()
+			if id.ItemRound >= len(history) {
+				log.Printf("%s requested random beacon of too high round: %d, need to be smaller than current round: %d\n", requester, id.ItemRound, len(history))
+				continue
+			}
+
+			p.RandBeaconSig(m.addr, history[id.ItemRound])
+		case BlockPartItem:
+			ps, ok := m.partSetFor(id.Hash)
+			if !ok {
+				continue
+			}
+
+			part, ok := ps.GetPart(id.Index)
+			if !ok {
+				continue
+			}
+
+			p.BlockPart(m.addr, id.Hash, part.Index, part.Proof, part.Bytes)
+		}
+	}
+
+	m.peers.MarkGood(requester)
+}
+
+// pingPeers contacts every peer in m.peers, recording its
+// self-reported height in the block pool so Sync knows how far behind
+// the node is and which peers can serve which rounds.
+func (m *ChainMgr) pingPeers() {
+	for addr, p := range m.peers.Snapshot() {
+		height, err := p.Ping(context.Background())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		m.pool.SetPeerHeight(addr, height)
+	}
+}
+
+// Sync catches the node up with its peers, in parallel across all of
+// them.
+func (m *ChainMgr) Sync() error {
+	m.pingPeers()
+	return m.pool.Sync(m.peers.Snapshot)
+}
@@ -0,0 +1,34 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestChainMgr() *ChainMgr {
+	return &ChainMgr{
+		partSets: make(map[Hash]*PartSet),
+		peerHave: make(map[Hash]map[string]*BitArray),
+	}
+}
+
+func TestChainMgrTrackPartEvictsOldest(t *testing.T) {
+	m := newTestChainMgr()
+
+	var first Hash
+	first[0] = 1
+	m.partSets[first] = NewPartSet([]byte("block"))
+	m.trackPart(first)
+
+	for i := 0; i < maxTrackedParts; i++ {
+		var h Hash
+		h[0] = byte(i + 2)
+		m.partSets[h] = NewPartSet([]byte("block"))
+		m.trackPart(h)
+	}
+
+	_, ok := m.partSets[first]
+	assert.False(t, ok, "oldest tracked hash should have been evicted once the cap was exceeded")
+	assert.LessOrEqual(t, len(m.partOrder), maxTrackedParts)
+}
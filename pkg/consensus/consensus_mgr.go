@@ -0,0 +1,227 @@
+package consensus
+
+import (
+	"errors"
+	"log"
+)
+
+// ConsensusMgr is the latency-critical consensus reactor: it handles
+// random beacon signature shares, block proposals and notarization
+// shares. It shares its PeerSet with ChainMgr so both reactors agree
+// on which addresses are connected and banned, but unlike ChainMgr it
+// broadcasts through the set's per-peer send queues, so a stuck peer
+// can't delay delivering a share to everyone else. Broadcasts for the
+// chain's current round go on the priority lane ahead of stale ones.
+type ConsensusMgr struct {
+	net   Network
+	addr  string
+	chain *Chain
+	v     *validator
+	peers *PeerSet
+
+	// onRandBeaconSig and onBlock hand a just-aggregated signature or
+	// notarized block to ChainMgr, which validates and rebroadcasts it
+	// the same way as one received directly from a peer. Set by
+	// Networking after both reactors are constructed, so ConsensusMgr
+	// doesn't need to depend on ChainMgr's concrete type.
+	onRandBeaconSig func(sender string, r *RandBeaconSig)
+	onBlock         func(sender string, b *Block)
+}
+
+// NewConsensusMgr creates a ConsensusMgr sharing peers with the rest
+// of the node's reactors.
+func NewConsensusMgr(net Network, addr string, chain *Chain, v *validator, peers *PeerSet) *ConsensusMgr {
+	return &ConsensusMgr{net: net, addr: addr, chain: chain, v: v, peers: peers}
+}
+
+// Broadcast advertises item to every peer through the set's send
+// queues, preferring the priority lane when item belongs to the
+// chain's current round.
+func (m *ConsensusMgr) Broadcast(item ItemID) {
+	priority := item.ItemRound == m.chain.Round()
+	m.peers.BroadcastMsg(priority, func(p Peer) {
+		p.Inventory(m.addr, []ItemID{item})
+	})
+}
+
+func (m *ConsensusMgr) recvRandBeaconSigShare(sender string, r *RandBeaconSigShare) {
+	groupID, valid := m.v.ValidateRandBeaconSigShare(r)
+	if !valid {
+		log.Printf("ValidateRandBeaconSigShare failed, owner: %x, round: %d\n", r.Owner, r.Round)
+		m.peers.StopForError(sender, errUnknownGroup)
+		return
+	}
+
+	sig, err := m.chain.RandomBeacon.RecvRandBeaconSigShare(r, groupID)
+	if errors.Is(err, errStaleRound) {
+		// Gossip rebroadcast routinely redelivers a share after the
+		// round has moved on; that's not misbehavior, so drop it
+		// without penalizing the sender.
+		log.Println(err)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		m.peers.StopForError(sender, errWrongRound)
+		return
+	}
+
+	m.peers.MarkGood(sender)
+	if sig != nil {
+		go m.onRandBeaconSig(m.addr, sig)
+		return
+	}
+
+	go m.Broadcast(ItemID{T: RandBeaconShareItem, Hash: r.Hash(), ItemRound: r.Round})
+}
+
+func (m *ConsensusMgr) recvBlockProposal(sender string, bp *BlockProposal) {
+	weight, valid := m.v.ValidateBlockProposal(bp)
+	if !valid {
+		log.Println("ValidateBlockProposal failed")
+		m.peers.StopForError(sender, errInvalidSig)
+		return
+	}
+
+	err := m.chain.addBP(bp, weight)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	m.peers.MarkGood(sender)
+	go m.Broadcast(ItemID{T: BlockProposalItem, Hash: bp.Hash(), ItemRound: bp.Round, Ref: bp.PrevBlock})
+}
+
+func (m *ConsensusMgr) recvNtShare(sender string, s *NtShare) {
+	groupID, valid := m.v.ValidateNtShare(s)
+	if !valid {
+		log.Println("ValidateNtShare failed")
+		m.peers.StopForError(sender, errUnknownGroup)
+		return
+	}
+
+	if cur := m.chain.Round(); s.Round != cur {
+		// Gossip rebroadcast routinely redelivers a notarization share
+		// after its round has advanced past it; that's not misbehavior,
+		// so mirror recvRandBeaconSigShare's errStaleRound handling and
+		// drop it without penalizing the sender.
+		log.Printf("recvNtShare: stale round %d, current %d\n", s.Round, cur)
+		return
+	}
+
+	b, err := m.chain.addNtShare(s, groupID)
+	if err != nil {
+		log.Println(err)
+		m.peers.StopForError(sender, errWrongRound)
+		return
+	}
+
+	m.peers.MarkGood(sender)
+	if b != nil {
+		go m.onBlock(m.addr, b)
+		return
+	}
+
+	// TODO: use multicast rather than broadcast
+	go m.Broadcast(ItemID{T: NtShareItem, Hash: s.Hash(), ItemRound: s.Round, Ref: s.BP})
+}
+
+// handleInventory serves the subset of an Inventory message that the
+// consensus reactor owns: BlockProposalItem, NtShareItem and
+// RandBeaconShareItem.
+func (m *ConsensusMgr) handleInventory(sender string, ids []ItemID) {
+	if len(ids) == 0 {
+		return
+	}
+
+	p, err := m.peers.FindOrConnect(m.net, sender)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	round := m.chain.Round()
+	for _, id := range ids {
+		switch id.T {
+		case BlockProposalItem:
+			if id.ItemRound != round {
+				log.Printf("recv bp for round: %d, handling: %d\n", id.ItemRound, round)
+				continue
+			}
+
+			if _, ok := m.chain.BlockProposal(id.Hash); ok {
+				continue
+			}
+
+			p.GetData(m.addr, []ItemID{id})
+		case NtShareItem:
+			if id.ItemRound != round {
+				log.Printf("recv nt for round: %d, handling: %d\n", id.ItemRound, round)
+				continue
+			}
+
+			if _, ok := m.chain.NtShare(id.Hash); ok {
+				continue
+			}
+
+			if !m.chain.NeedNotarize(id.Ref) {
+				m.peers.StopForError(sender, errUnknownRef)
+				continue
+			}
+
+			p.GetData(m.addr, []ItemID{id})
+		case RandBeaconShareItem:
+			if id.ItemRound != round {
+				log.Printf("recv random beacon share for round: %d, handling: %d\n", id.ItemRound, round)
+				continue
+			}
+
+			share := m.chain.RandomBeacon.GetShare(id.Hash)
+			if share != nil {
+				continue
+			}
+			p.GetData(m.addr, []ItemID{id})
+		}
+	}
+}
+
+// serveData answers the subset of a GetData request that the
+// consensus reactor owns: BlockProposalItem, NtShareItem and
+// RandBeaconShareItem.
+func (m *ConsensusMgr) serveData(requester string, ids []ItemID) {
+	if len(ids) == 0 {
+		return
+	}
+
+	p, err := m.peers.FindOrConnect(m.net, requester)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, id := range ids {
+		switch id.T {
+		case BlockProposalItem:
+			bp, ok := m.chain.BlockProposal(id.Hash)
+			if !ok {
+				continue
+			}
+			p.BlockProposal(m.addr, bp)
+		case NtShareItem:
+			nts, ok := m.chain.NtShare(id.Hash)
+			if !ok {
+				continue
+			}
+			p.NotarizationShare(m.addr, nts)
+		case RandBeaconShareItem:
+			share := m.chain.RandomBeacon.GetShare(id.Hash)
+			if share == nil {
+				continue
+			}
+			p.RandBeaconSigShare(m.addr, share)
+		}
+	}
+
+	m.peers.MarkGood(requester)
+}
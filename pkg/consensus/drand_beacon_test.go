@@ -0,0 +1,65 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/dfinity/go-dfinity-crypto/bls"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBeaconNetworksPubKeyForRound(t *testing.T) {
+	n := NewBeaconNetworks()
+	n.Register(0, "key-v1")
+	n.Register(100, "key-v2")
+
+	pk, ok := n.PubKeyForRound(0)
+	assert.True(t, ok)
+	assert.Equal(t, "key-v1", pk)
+
+	pk, ok = n.PubKeyForRound(99)
+	assert.True(t, ok)
+	assert.Equal(t, "key-v1", pk)
+
+	pk, ok = n.PubKeyForRound(100)
+	assert.True(t, ok)
+	assert.Equal(t, "key-v2", pk)
+
+	_, ok = NewBeaconNetworks().PubKeyForRound(0)
+	assert.False(t, ok, "an empty registry has no key for any round")
+}
+
+func TestBeaconNetworksActivationAfter(t *testing.T) {
+	n := NewBeaconNetworks()
+	n.Register(0, "key-v1")
+	n.Register(100, "key-v2")
+	n.Register(200, "key-v3")
+
+	activate, ok := n.ActivationAfter(50)
+	assert.True(t, ok)
+	assert.Equal(t, 100, activate)
+
+	_, ok = n.ActivationAfter(200)
+	assert.False(t, ok, "no activation exists strictly after the last registered round")
+}
+
+func TestDrandBeaconVerifyEntry(t *testing.T) {
+	assert.NoError(t, bls.Init(bls.CurveFp254BNb))
+
+	var sec bls.SecretKey
+	sec.SetByCSPRNG()
+	pub := sec.GetPublicKey()
+
+	networks := NewBeaconNetworks()
+	networks.Register(0, pub.SerializeToHexStr())
+	d := &drandBeacon{networks: networks}
+
+	prev := BeaconEntry{Round: 0, Sig: sec.Sign("genesis").Serialize()}
+	curSig := sec.Sign(string(drandRoundMessage(1, prev.Sig)))
+	cur := BeaconEntry{Round: 1, Sig: curSig.Serialize(), PrevRound: 0, PrevSig: prev.Sig}
+
+	assert.NoError(t, d.VerifyEntry(cur, prev))
+
+	forged := cur
+	forged.Sig = sec.Sign("forged").Serialize()
+	assert.Error(t, d.VerifyEntry(forged, prev), "a signature over the wrong message must not verify")
+}
@@ -4,24 +4,54 @@ import (
 	"context"
 	"errors"
 	"log"
-	"sync"
+	"math/rand"
+	"time"
+)
+
+var (
+	errInvalidSig   = errors.New("invalid signature")
+	errWrongRound   = errors.New("wrong round")
+	errUnknownGroup = errors.New("unknown group")
+	errUnknownRef   = errors.New("inventory references an unknown hash")
 )
 
 // Peer is a peer node in the DEX network.
 type Peer interface {
 	Txn(txn []byte) error
 	SysTxn(s *SysTxn) error
-	RandBeaconSigShare(r *RandBeaconSigShare) error
-	RandBeaconSig(r *RandBeaconSig) error
-	Block(b *Block) error
-	BlockProposal(b *BlockProposal) error
-	NotarizationShare(n *NtShare) error
+	// RandBeaconSigShare, RandBeaconSig, Block, BlockProposal and
+	// NotarizationShare all carry the sender's address so the
+	// receiving reactor can credit or penalize the sender through the
+	// shared PeerSet, the same way Inventory and GetData already do.
+	RandBeaconSigShare(sender string, r *RandBeaconSigShare) error
+	RandBeaconSig(sender string, r *RandBeaconSig) error
+	Block(sender string, b *Block) error
+	BlockProposal(sender string, b *BlockProposal) error
+	NotarizationShare(sender string, n *NtShare) error
 	Inventory(sender string, items []ItemID) error
 	GetData(requester string, items []ItemID) error
+	// HasParts advertises the sender's PartSetHeader and which parts of
+	// it the sender already has, so the receiver can request only the
+	// parts it is missing instead of the whole block.
+	HasParts(sender string, h Hash, header PartSetHeader, bits *BitArray) error
+	// BlockPart delivers a single verified part of a block's PartSet.
+	BlockPart(sender string, h Hash, index int, proof []Hash, data []byte) error
 	Peers() ([]string, error)
-	UpdatePeers([]string) error
-	Ping(ctx context.Context) error
-	Sync(start int) ([]*RandBeaconSig, []*Block, error)
+	// UpdatePeers carries sender so updatePeers can bucket the
+	// addresses by source group in the address book, the same way
+	// RequestAddrs responses are.
+	UpdatePeers(sender string, addrs []string) error
+	// RequestAddrs asks the peer for a bounded random sample of
+	// addresses from its address book, for peer exchange.
+	RequestAddrs() ([]string, error)
+	// Ping also returns the peer's self-reported chain height, used by
+	// the block pool to compute the sync target and to detect peers
+	// lying about how far ahead they are.
+	Ping(ctx context.Context) (height int, err error)
+	// Sync returns the random beacon signatures and blocks for the
+	// half-open round range [start, end). end == 0 means "through the
+	// peer's latest round".
+	Sync(start, end int) ([]*RandBeaconSig, []*Block, error)
 }
 
 // TODO: networking should ensure that adding things to the chain is
@@ -39,6 +69,9 @@ const (
 	NtShareItem
 	RandBeaconShareItem
 	RandBeaconItem
+	// BlockPartItem identifies a single part of a block's PartSet,
+	// rather than the whole block.
+	BlockPartItem
 )
 
 // ItemID is the identification of an item that the current node owns.
@@ -47,6 +80,9 @@ type ItemID struct {
 	ItemRound int
 	Ref       Hash
 	Hash      Hash
+	// Index is the part index, only meaningful when T is
+	// BlockPartItem.
+	Index int
 }
 
 // Network is used to connect to the peers.
@@ -56,27 +92,44 @@ type Network interface {
 }
 
 // Networking is the component that enables the node to talk to its
-// peers over the network.
+// peers over the network. It owns the peer address book and the
+// shared PeerSet registry, and dispatches incoming RPCs between its
+// two reactors: ChainMgr, which handles chain-sync traffic, and
+// ConsensusMgr, which handles latency-critical consensus traffic. The
+// two reactors share a PeerSet so a peer evicted by one is evicted for
+// both, but ConsensusMgr additionally broadcasts through the set's
+// per-peer send queues so a stuck peer can't delay a share reaching
+// everyone else.
 type Networking struct {
-	net   Network
-	addr  string
-	v     *validator
-	chain *Chain
-
-	mu        sync.Mutex
-	peers     map[string]Peer
-	peerAddrs map[string]bool
-}
+	net      Network
+	addr     string
+	addrBook *AddrBook
+	peers    *PeerSet
+
+	chain        *Chain
+	chainMgr     *ChainMgr
+	consensusMgr *ConsensusMgr
+}
+
+// NewNetworking creates a new networking component. addrBookPath is
+// where the peer address book is persisted (gob-encoded) across
+// restarts.
+func NewNetworking(net Network, v *validator, addr string, chain *Chain, addrBookPath string) *Networking {
+	peers := NewPeerSet()
+	chainMgr := NewChainMgr(net, addr, chain, v, peers)
+	consensusMgr := NewConsensusMgr(net, addr, chain, v, peers)
+	consensusMgr.onRandBeaconSig = chainMgr.recvRandBeaconSig
+	consensusMgr.onBlock = chainMgr.recvBlock
+	peers.OnEvict(chainMgr.pool.DropPeer)
 
-// NewNetworking creates a new networking component.
-func NewNetworking(net Network, v *validator, addr string, chain *Chain) *Networking {
 	return &Networking{
-		addr:      addr,
-		net:       net,
-		v:         v,
-		peers:     make(map[string]Peer),
-		peerAddrs: make(map[string]bool),
-		chain:     chain,
+		addr:         addr,
+		net:          net,
+		addrBook:     NewAddrBook(addrBookPath),
+		peers:        peers,
+		chain:        chain,
+		chainMgr:     chainMgr,
+		consensusMgr: consensusMgr,
 	}
 }
 
@@ -97,345 +150,187 @@ func (n *Networking) Start(seedAddr string) error {
 		return err
 	}
 
-	n.mu.Lock()
-	n.peers[seedAddr] = p
+	n.peers.Add(seedAddr, p)
+
+	n.addrBook.AddAddress(seedAddr, seedAddr)
 	for _, addr := range peerAddrs {
-		// TODO: check peers is online
-		n.peerAddrs[addr] = true
+		n.addrBook.AddAddress(addr, seedAddr)
 	}
-	n.mu.Unlock()
 
 	// TODO: limit the number of peers connected to
-	for addr := range n.peerAddrs {
-		_, err = n.findOrConnect(addr)
+	for _, addr := range peerAddrs {
+		_, err = n.peers.FindOrConnect(n.net, addr)
 		if err != nil {
 			log.Println(err)
 		}
 	}
 
-	// TODO: sync random beacon from other peers rather than the
-	// seed
-
-	rb, bs, err := p.Sync(len(n.chain.RandomBeacon.History()))
-	if err != nil {
+	// Catch up the random beacon history and the finalized chain in
+	// parallel across all known peers, rather than serializing the
+	// whole download behind the single seed peer.
+	if err := n.chainMgr.Sync(); err != nil {
 		return err
 	}
 
-	for _, r := range rb {
-		err = n.chain.RandomBeacon.RecvRandBeaconSig(r)
-		if err != nil {
-			return err
-		}
-	}
-
-	for _, b := range bs {
-		weight, valid := n.v.ValidateBlock(b)
-		if !valid {
-			return errors.New("invalid block when syncing")
-		}
-		err = n.chain.addBlock(b, weight)
-		if err != nil {
-			return err
-		}
-	}
-
+	go n.dialLoop()
+	go n.pexLoop()
+	go n.addrBookSaveLoop()
 	return nil
 }
 
-// TODO: don't broadcast when syncing.
+// addrBookSaveInterval is how often the address book is persisted to
+// disk, so a restarted node keeps what it has already learned about
+// its peers instead of falling back to the seed node alone.
+const addrBookSaveInterval = time.Minute
 
-// BroadcastItem broadcast the item id to its peers.
-func (n *Networking) BroadcastItem(item ItemID) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
+// addrBookSaveLoop periodically persists the address book to disk.
+func (n *Networking) addrBookSaveLoop() {
+	ticker := time.NewTicker(addrBookSaveInterval)
+	defer ticker.Stop()
 
-	for _, p := range n.peers {
-		p := p
-		go func() {
-			p.Inventory(n.addr, []ItemID{item})
-		}()
+	for range ticker.C {
+		if err := n.addrBook.Save(); err != nil {
+			log.Println(err)
+		}
 	}
 }
 
-func (n *Networking) recvTxn(t []byte) {
-	panic("not implemented")
-}
-
-func (n *Networking) recvSysTxn(t *SysTxn) {
-	panic("not implemented")
-}
-
-func (n *Networking) recvRandBeaconSig(r *RandBeaconSig) {
-	if !n.v.ValidateRandBeaconSig(r) {
-		log.Printf("ValidateRandBeaconSig failed, round: %d\n", r.Round)
-		return
-	}
+// targetOutboundPeers is how many outbound connections the dial loop
+// tries to maintain.
+const targetOutboundPeers = 8
 
-	err := n.chain.RandomBeacon.RecvRandBeaconSig(r)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	go n.BroadcastItem(ItemID{T: RandBeaconItem, Hash: r.Hash(), ItemRound: r.Round})
-}
+// pexInterval is how often the node asks a random connected peer for
+// more addresses.
+const pexInterval = 30 * time.Second
 
-func (n *Networking) recvRandBeaconSigShare(r *RandBeaconSigShare) {
-	groupID, valid := n.v.ValidateRandBeaconSigShare(r)
+// dialLoop maintains targetOutboundPeers outbound connections, pulling
+// candidate addresses from the address book. It biases toward the old
+// (known-good) bucket once the node already has many peers, and toward
+// the new bucket when it has few, to diversify the peer set.
+func (n *Networking) dialLoop() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 
-	if !valid {
-		log.Printf("ValidateRandBeaconSigShare failed, owner: %x, round: %d\n", r.Owner, r.Round)
-		return
-	}
+	for range ticker.C {
+		live := n.peers.List()
+		if len(live) >= targetOutboundPeers {
+			continue
+		}
 
-	sig, err := n.chain.RandomBeacon.RecvRandBeaconSigShare(r, groupID)
-	if err != nil {
-		log.Println(err)
-		return
-	}
+		biasOld := len(live) >= targetOutboundPeers/2
+		addr, ok := n.addrBook.PickAddress(biasOld)
+		if !ok {
+			continue
+		}
 
-	if sig != nil {
-		go n.recvRandBeaconSig(sig)
-		return
+		_, err := n.peers.FindOrConnect(n.net, addr)
+		n.addrBook.MarkAttempt(addr, err == nil)
+		if err != nil {
+			log.Println(err)
+		}
 	}
-
-	go n.BroadcastItem(ItemID{T: RandBeaconShareItem, Hash: r.Hash(), ItemRound: r.Round})
 }
 
-func (n *Networking) recvBlock(b *Block) {
-	weight, valid := n.v.ValidateBlock(b)
-
-	if !valid {
-		log.Println("ValidateBlock failed")
-		return
-	}
-
-	// TODO: make sure received all block's parents and block
-	// proposal before processing this block.
+// pexLoop periodically asks a random connected peer for more
+// addresses and feeds the (deduped, validated) result into the address
+// book.
+func (n *Networking) pexLoop() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
 
-	err := n.chain.addBlock(b, weight)
-	if err != nil {
-		log.Println(err)
-		return
-	}
+	for range ticker.C {
+		live := n.peers.List()
+		if len(live) == 0 {
+			continue
+		}
 
-	go n.BroadcastItem(ItemID{T: BlockItem, Hash: b.Hash(), ItemRound: b.Round, Ref: b.PrevBlock})
-}
+		addr := live[rand.Intn(len(live))]
+		p, ok := n.peers.Get(addr)
+		if !ok {
+			continue
+		}
 
-func (n *Networking) recvBlockProposal(bp *BlockProposal) {
-	weight, valid := n.v.ValidateBlockProposal(bp)
-	if !valid {
-		log.Println("ValidateBlockProposal failed")
-		return
-	}
+		addrs, err := p.RequestAddrs()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 
-	err := n.chain.addBP(bp, weight)
-	if err != nil {
-		log.Println(err)
-		return
+		n.updatePeers(addr, addrs)
 	}
-
-	go n.BroadcastItem(ItemID{T: BlockProposalItem, Hash: bp.Hash(), ItemRound: bp.Round, Ref: bp.PrevBlock})
 }
 
-func (n *Networking) recvNtShare(s *NtShare) {
-	groupID, valid := n.v.ValidateNtShare(s)
-	if !valid {
-		log.Println("ValidateNtShare failed")
-		return
-	}
-
-	b, err := n.chain.addNtShare(s, groupID)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	if b != nil {
-		go n.recvBlock(b)
-		return
-	}
-
-	// TODO: use multicast rather than broadcast
-	go n.BroadcastItem(ItemID{T: NtShareItem, Hash: s.Hash(), ItemRound: s.Round, Ref: s.BP})
+func (n *Networking) recvTxn(t []byte) {
+	panic("not implemented")
 }
 
-// must be called with mutex held.
-func (n *Networking) findOrConnect(addr string) (Peer, error) {
-	if p, ok := n.peers[addr]; ok {
-		return p, nil
-	}
-
-	p, err := n.net.Connect(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	n.peers[addr] = p
-	return p, nil
+func (n *Networking) recvSysTxn(t *SysTxn) {
+	panic("not implemented")
 }
 
+// recvInventory routes each item in an Inventory message to the
+// reactor that owns its ItemType.
 func (n *Networking) recvInventory(sender string, ids []ItemID) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-
-	p, err := n.findOrConnect(sender)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	round := n.chain.Round()
+	var chainIDs, consensusIDs []ItemID
 	for _, id := range ids {
 		switch id.T {
-		case TxnItem:
-			panic("not implemented")
-		case SysTxnItem:
-			panic("not implemented")
-		case BlockItem:
-			// TODO: improve logic of what to get, e.g., using id.Ref
-			if _, ok := n.chain.Block(id.Hash); !ok {
-				p.GetData(n.addr, []ItemID{id})
-			}
-		case BlockProposalItem:
-			if id.ItemRound != round {
-				log.Printf("recv bp for round: %d, handling: %d\n", id.ItemRound, round)
-				continue
-			}
-
-			if _, ok := n.chain.BlockProposal(id.Hash); ok {
-				continue
-			}
-
-			p.GetData(n.addr, []ItemID{id})
-		case NtShareItem:
-			if id.ItemRound != round {
-				log.Printf("recv nt for round: %d, handling: %d\n", id.ItemRound, round)
-				continue
-			}
-
-			if _, ok := n.chain.NtShare(id.Hash); ok {
-				continue
-			}
-
-			if !n.chain.NeedNotarize(id.Ref) {
-				continue
-			}
-
-			p.GetData(n.addr, []ItemID{id})
-		case RandBeaconShareItem:
-			if id.ItemRound != round {
-				log.Printf("recv random beacon share for round: %d, handling: %d\n", id.ItemRound, round)
-				continue
-			}
-
-			share := n.chain.RandomBeacon.GetShare(id.Hash)
-			if share != nil {
-				continue
-			}
-			p.GetData(n.addr, []ItemID{id})
-		case RandBeaconItem:
-			if id.ItemRound != round {
-				log.Printf("recv random beacon share for round: %d, handling: %d\n", id.ItemRound, round)
-				continue
-			}
-
-			p.GetData(n.addr, []ItemID{id})
+		case BlockItem, RandBeaconItem:
+			chainIDs = append(chainIDs, id)
+		case BlockProposalItem, NtShareItem, RandBeaconShareItem:
+			consensusIDs = append(consensusIDs, id)
+		default:
+			log.Printf("recvInventory: unhandled item type %v\n", id.T)
 		}
 	}
-}
-
-func (n *Networking) getSyncData(start int) ([]*RandBeaconSig, []*Block) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	history := n.chain.RandomBeacon.History()
-	if len(history) <= start {
-		return nil, nil
-	}
 
-	blocks := n.chain.FinalizedChain()
-	if len(blocks) <= start {
-		blocks = nil
-	} else {
-		blocks = blocks[start:]
-	}
-
-	return history[start:], blocks
+	n.chainMgr.handleInventory(sender, chainIDs)
+	n.consensusMgr.handleInventory(sender, consensusIDs)
 }
 
+// serveData routes each item in a GetData request to the reactor that
+// owns its ItemType.
 func (n *Networking) serveData(requester string, ids []ItemID) {
-	p, err := n.findOrConnect(requester)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
+	var chainIDs, consensusIDs []ItemID
 	for _, id := range ids {
 		switch id.T {
-		case TxnItem:
-			panic("not implemented")
-		case SysTxnItem:
-			panic("not implemented")
-		case BlockItem:
-			b, ok := n.chain.Block(id.Hash)
-			if !ok {
-				continue
-			}
-			p.Block(b)
-		case BlockProposalItem:
-			bp, ok := n.chain.BlockProposal(id.Hash)
-			if !ok {
-				continue
-			}
-			p.BlockProposal(bp)
-		case NtShareItem:
-			nts, ok := n.chain.NtShare(id.Hash)
-			if !ok {
-				continue
-			}
-			p.NotarizationShare(nts)
-		case RandBeaconShareItem:
-			share := n.chain.RandomBeacon.GetShare(id.Hash)
-			if share == nil {
-				continue
-			}
-
-			p.RandBeaconSigShare(share)
-		case RandBeaconItem:
-			history := n.chain.RandomBeacon.History()
-			if id.ItemRound >= len(history) {
-				log.Printf("%s requested random beacon of too high round: %d, need to be smaller than current round: %d\n", requester, id.ItemRound, len(history))
-				continue
-			}
-
-			p.RandBeaconSig(history[id.ItemRound])
+		case BlockItem, RandBeaconItem, BlockPartItem:
+			chainIDs = append(chainIDs, id)
+		case BlockProposalItem, NtShareItem, RandBeaconShareItem:
+			consensusIDs = append(consensusIDs, id)
+		default:
+			log.Printf("serveData: unhandled item type %v\n", id.T)
 		}
 	}
+
+	n.chainMgr.serveData(requester, chainIDs)
+	n.consensusMgr.serveData(requester, consensusIDs)
 }
 
+// peerList returns addresses from the address book rather than the
+// transient set of currently-connected peers, so a requester learns
+// about addresses the node isn't even dialed to right now.
 func (n *Networking) peerList() []string {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-
-	list := make([]string, 0, len(n.peerAddrs))
-	for addr := range n.peerAddrs {
-		list = append(list, addr)
-	}
-
-	// TODO: periodically verify the addrs in peerAddrs are valid
-	// by using Ping.
-	return list
+	return n.addrBook.Sample(pexSampleSize)
 }
 
-func (n *Networking) updatePeers([]string) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
+// updatePeers validates and dedupes addrs before feeding them into the
+// address book, bucketed by sender so a single source can't flood the
+// book.
+func (n *Networking) updatePeers(sender string, addrs []string) {
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
 
-	// TODO: validate, dedup the peer list
+		n.addrBook.AddAddress(addr, sender)
+	}
 }
 
-// receiver implements the Peer interface. It forwards the peers'
-// queries to the networking component.
+// receiver implements the Peer interface. It is a thin dispatcher: it
+// forwards each RPC to whichever reactor owns it, based on the RPC
+// itself for direct calls and on ItemType for Inventory/GetData.
 type receiver struct {
 	addr string
 	n    *Networking
@@ -455,28 +350,28 @@ func (r *receiver) SysTxn(t *SysTxn) error {
 	return nil
 }
 
-func (r *receiver) RandBeaconSigShare(s *RandBeaconSigShare) error {
-	r.n.recvRandBeaconSigShare(s)
+func (r *receiver) RandBeaconSigShare(sender string, s *RandBeaconSigShare) error {
+	r.n.consensusMgr.recvRandBeaconSigShare(sender, s)
 	return nil
 }
 
-func (r *receiver) RandBeaconSig(s *RandBeaconSig) error {
-	r.n.recvRandBeaconSig(s)
+func (r *receiver) RandBeaconSig(sender string, s *RandBeaconSig) error {
+	r.n.chainMgr.recvRandBeaconSig(sender, s)
 	return nil
 }
 
-func (r *receiver) Block(b *Block) error {
-	r.n.recvBlock(b)
+func (r *receiver) Block(sender string, b *Block) error {
+	r.n.chainMgr.recvBlock(sender, b)
 	return nil
 }
 
-func (r *receiver) BlockProposal(bp *BlockProposal) error {
-	r.n.recvBlockProposal(bp)
+func (r *receiver) BlockProposal(sender string, bp *BlockProposal) error {
+	r.n.consensusMgr.recvBlockProposal(sender, bp)
 	return nil
 }
 
-func (r *receiver) NotarizationShare(n *NtShare) error {
-	r.n.recvNtShare(n)
+func (r *receiver) NotarizationShare(sender string, n *NtShare) error {
+	r.n.consensusMgr.recvNtShare(sender, n)
 	return nil
 }
 
@@ -490,8 +385,18 @@ func (r *receiver) GetData(requester string, ids []ItemID) error {
 	return nil
 }
 
-func (r *receiver) Sync(start int) ([]*RandBeaconSig, []*Block, error) {
-	rb, bs := r.n.getSyncData(start)
+func (r *receiver) HasParts(sender string, h Hash, header PartSetHeader, bits *BitArray) error {
+	r.n.chainMgr.recvHasParts(sender, h, header, bits)
+	return nil
+}
+
+func (r *receiver) BlockPart(sender string, h Hash, index int, proof []Hash, data []byte) error {
+	r.n.chainMgr.recvBlockPart(sender, h, index, proof, data)
+	return nil
+}
+
+func (r *receiver) Sync(start, end int) ([]*RandBeaconSig, []*Block, error) {
+	rb, bs := r.n.chainMgr.getSyncData(start, end)
 	return rb, bs, nil
 }
 
@@ -499,11 +404,15 @@ func (r *receiver) Peers() ([]string, error) {
 	return r.n.peerList(), nil
 }
 
-func (r *receiver) UpdatePeers(peers []string) error {
-	r.n.updatePeers(peers)
+func (r *receiver) UpdatePeers(sender string, addrs []string) error {
+	r.n.updatePeers(sender, addrs)
 	return nil
 }
 
-func (r *receiver) Ping(ctx context.Context) error {
-	return nil
+func (r *receiver) RequestAddrs() ([]string, error) {
+	return r.n.peerList(), nil
+}
+
+func (r *receiver) Ping(ctx context.Context) (int, error) {
+	return len(r.n.chain.RandomBeacon.History()), nil
 }
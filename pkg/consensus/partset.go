@@ -0,0 +1,264 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// partSize is the size, in bytes, of each part a block's serialized
+// body is split into before being gossiped. 64 KB keeps individual
+// gossip messages small enough that a single slow part doesn't stall
+// the whole block from propagating.
+const partSize = 64 * 1024
+
+// maxBlockBodySize bounds how large a block's serialized body is ever
+// allowed to be, and so how many parts a PartSetHeader may legitimately
+// claim. maxPartsPerBlock is derived from it so NewPartSetFromHeader
+// can reject a header.Total that no real block could produce, before
+// allocating anything sized by it.
+const maxBlockBodySize = 16 * 1024 * 1024
+const maxPartsPerBlock = maxBlockBodySize / partSize
+
+// PartSetHeader identifies a PartSet without carrying its contents: it
+// is what gets gossiped first, so a peer can tell what it is missing
+// before asking for the (possibly large) parts themselves.
+type PartSetHeader struct {
+	Total int
+	Root  Hash
+}
+
+// Part is a single chunk of a block's serialized body, along with the
+// Merkle proof that ties it back to the PartSetHeader's Root.
+type Part struct {
+	Index int
+	Bytes []byte
+	Proof []Hash
+}
+
+// PartSet splits a block's serialized body into fixed-size parts for
+// gossip, so peers can fetch only the parts they are missing instead
+// of receiving the full block in one message. It is also used on the
+// receiving side to buffer parts until enough have arrived to
+// reassemble the block.
+type PartSet struct {
+	header PartSetHeader
+
+	mu    sync.Mutex
+	parts []*Part
+	have  *BitArray
+}
+
+// NewPartSet splits data into parts of partSize bytes, computes the
+// Merkle root over them, and returns a PartSet that already has every
+// part (used when the local node assembles a new block).
+func NewPartSet(data []byte) *PartSet {
+	var parts []*Part
+	for i := 0; i < len(data); i += partSize {
+		end := i + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		parts = append(parts, &Part{Index: len(parts), Bytes: data[i:end]})
+	}
+
+	if len(parts) == 0 {
+		parts = []*Part{{Index: 0, Bytes: []byte{}}}
+	}
+
+	leaves := make([]Hash, len(parts))
+	for i, p := range parts {
+		leaves[i] = hash(p.Bytes)
+	}
+
+	root := merkleRoot(leaves)
+	for i, p := range parts {
+		p.Proof = merkleProof(leaves, i)
+	}
+
+	have := NewBitArray(len(parts))
+	for i := range parts {
+		have.SetIndex(i, true)
+	}
+
+	return &PartSet{
+		header: PartSetHeader{Total: len(parts), Root: root},
+		parts:  parts,
+		have:   have,
+	}
+}
+
+// NewPartSetFromHeader returns an empty PartSet expecting header.Total
+// parts that hash to header.Root, used on the receiving side before
+// any part has arrived. header comes straight off the wire from a
+// peer's HasParts advertisement, so header.Total is validated against
+// maxPartsPerBlock before it's used to size any allocation: an
+// unbounded or negative value would otherwise let a single advertised
+// header force a huge allocation, or panic make() outright.
+func NewPartSetFromHeader(header PartSetHeader) (*PartSet, error) {
+	// A real block, even an empty one, always serializes to at least
+	// one part (see NewPartSet), so Total < 1 can only come from a
+	// malicious or buggy peer.
+	if header.Total < 1 || header.Total > maxPartsPerBlock {
+		return nil, fmt.Errorf("partset: header.Total %d outside valid range [1, %d]", header.Total, maxPartsPerBlock)
+	}
+
+	return &PartSet{
+		header: header,
+		parts:  make([]*Part, header.Total),
+		have:   NewBitArray(header.Total),
+	}, nil
+}
+
+// Header returns the PartSet's header.
+func (s *PartSet) Header() PartSetHeader {
+	return s.header
+}
+
+// BitArray returns a copy of the set of parts currently held, safe to
+// hand to a peer in HasParts without risking a data race as more parts
+// arrive.
+func (s *PartSet) BitArray() *BitArray {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.have.Copy()
+}
+
+// AddPart verifies part against the PartSet's Merkle root and, if
+// valid, records it. It returns an error if the index is out of range
+// or the proof doesn't verify, so the caller can penalize whoever sent
+// it.
+func (s *PartSet) AddPart(part *Part) error {
+	if part.Index < 0 || part.Index >= s.header.Total {
+		return errors.New("partset: part index out of range")
+	}
+
+	leaf := hash(part.Bytes)
+	if !verifyMerkleProof(leaf, part.Index, s.header.Total, part.Proof, s.header.Root) {
+		return errors.New("partset: part failed Merkle proof verification")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parts[part.Index] = part
+	s.have.SetIndex(part.Index, true)
+	return nil
+}
+
+// GetPart returns the part at index, if it has arrived.
+func (s *PartSet) GetPart(index int) (*Part, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.parts) || s.parts[index] == nil {
+		return nil, false
+	}
+	return s.parts[index], true
+}
+
+// IsComplete reports whether every part has arrived.
+func (s *PartSet) IsComplete() bool {
+	return s.BitArray().IsFull()
+}
+
+// Bytes reassembles the full serialized body from its parts. It must
+// only be called once IsComplete reports true.
+func (s *PartSet) Bytes() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for i, p := range s.parts {
+		if p == nil {
+			return nil, fmt.Errorf("partset: missing part at index %d", i)
+		}
+		buf = append(buf, p.Bytes...)
+	}
+	return buf, nil
+}
+
+// merkleRoot computes a simple binary Merkle root over leaves. An
+// empty or single-leaf input returns that leaf's hash (or the zero
+// hash for no leaves).
+func merkleRoot(leaves []Hash) Hash {
+	switch len(leaves) {
+	case 0:
+		return Hash{}
+	case 1:
+		return leaves[0]
+	default:
+		k := split(len(leaves))
+		left := merkleRoot(leaves[:k])
+		right := merkleRoot(leaves[k:])
+		return hash(append(left[:], right[:]...))
+	}
+}
+
+// merkleProof returns the sibling hashes from leaf i up to the root,
+// in bottom-up order, for the given leaf set.
+func merkleProof(leaves []Hash, i int) []Hash {
+	if len(leaves) <= 1 {
+		return nil
+	}
+
+	k := split(len(leaves))
+	if i < k {
+		sibling := merkleRoot(leaves[k:])
+		return append(merkleProof(leaves[:k], i), sibling)
+	}
+
+	sibling := merkleRoot(leaves[:k])
+	return append(merkleProof(leaves[k:], i-k), sibling)
+}
+
+// verifyMerkleProof recomputes the root from leaf using proof and
+// compares it against root. merkleProof returns siblings in bottom-up
+// order (closest to the leaf first), so verification first walks the
+// split tree top-down to learn, at each depth, whether index falls in
+// the left or right subtree, then replays those decisions bottom-up
+// against proof to match the order the siblings were recorded in.
+func verifyMerkleProof(leaf Hash, index, total int, proof []Hash, root Hash) bool {
+	if total <= 1 {
+		return len(proof) == 0 && leaf == root
+	}
+
+	var isLeft []bool
+	n, i := total, index
+	for n > 1 {
+		k := split(n)
+		if i < k {
+			isLeft = append(isLeft, true)
+			n = k
+		} else {
+			isLeft = append(isLeft, false)
+			i -= k
+			n -= k
+		}
+	}
+
+	if len(isLeft) != len(proof) {
+		return false
+	}
+
+	cur := leaf
+	for j, sibling := range proof {
+		if isLeft[len(isLeft)-1-j] {
+			cur = hash(append(cur[:], sibling[:]...))
+		} else {
+			cur = hash(append(sibling[:], cur[:]...))
+		}
+	}
+	return cur == root
+}
+
+// split returns the size of the left subtree for a Merkle tree over n
+// leaves: the largest power of two strictly smaller than n.
+func split(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
@@ -0,0 +1,199 @@
+package consensus
+
+import (
+	"fmt"
+	"sync"
+)
+
+// peerQueueSize bounds how many pending sends PeerSet buffers per peer
+// per priority lane before it starts dropping rather than blocking the
+// caller.
+const peerQueueSize = 32
+
+// peerQueue is a single peer's pair of send lanes: priority and
+// normal. A dedicated goroutine drains both, always preferring
+// priority, so a burst of low-priority sends can't delay a
+// high-priority one already queued behind them.
+type peerQueue struct {
+	priority chan func(Peer)
+	normal   chan func(Peer)
+	done     chan struct{}
+}
+
+// PeerSet is an indexed, RW-mutexed registry of connected peers, keyed
+// by remote address. ChainMgr and ConsensusMgr share a single PeerSet
+// so both reactors agree on which addresses are connected and banned,
+// even though only ConsensusMgr makes use of the per-peer send queues
+// (ChainMgr's sync traffic is already throttled by the block pool's
+// own in-flight window and calls peers directly).
+type PeerSet struct {
+	mu     sync.RWMutex
+	peers  map[string]Peer
+	queues map[string]*peerQueue
+
+	reputation
+	// onEvict, when set, is notified with a peer's address when it is
+	// evicted for bad behavior, so an owner with its own per-peer
+	// bookkeeping (the block pool's in-flight requests) can discard it
+	// too.
+	onEvict func(addr string)
+}
+
+// NewPeerSet creates an empty PeerSet.
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
+		peers:      make(map[string]Peer),
+		queues:     make(map[string]*peerQueue),
+		reputation: newReputation(),
+	}
+}
+
+// OnEvict registers fn to be called whenever a peer is evicted for
+// crossing the reputation score threshold.
+func (s *PeerSet) OnEvict(fn func(addr string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onEvict = fn
+}
+
+// Add registers p under addr and starts its send-queue worker. It is a
+// no-op if addr is already registered.
+func (s *PeerSet) Add(addr string, p Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.peers[addr]; ok {
+		return
+	}
+
+	s.peers[addr] = p
+	q := &peerQueue{
+		priority: make(chan func(Peer), peerQueueSize),
+		normal:   make(chan func(Peer), peerQueueSize),
+		done:     make(chan struct{}),
+	}
+	s.queues[addr] = q
+	go runPeerQueue(p, q)
+}
+
+// runPeerQueue drains q against p until q.done is closed, always
+// preferring a pending priority send over a pending normal one.
+func runPeerQueue(p Peer, q *peerQueue) {
+	for {
+		select {
+		case fn := <-q.priority:
+			fn(p)
+			continue
+		default:
+		}
+
+		select {
+		case fn := <-q.priority:
+			fn(p)
+		case fn := <-q.normal:
+			fn(p)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Remove drops addr from the set and stops its send-queue worker.
+func (s *PeerSet) Remove(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if q, ok := s.queues[addr]; ok {
+		close(q.done)
+		delete(s.queues, addr)
+	}
+	delete(s.peers, addr)
+}
+
+// Get returns the peer registered under addr, if any.
+func (s *PeerSet) Get(addr string) (Peer, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.peers[addr]
+	return p, ok
+}
+
+// List returns the addresses currently registered.
+func (s *PeerSet) List() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Snapshot returns a copy of the currently registered peers, safe for
+// a caller to range over without holding the PeerSet's lock. Its
+// signature matches what BlockPool.Sync expects for enumerating live
+// peers.
+func (s *PeerSet) Snapshot() map[string]Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	peers := make(map[string]Peer, len(s.peers))
+	for addr, p := range s.peers {
+		peers[addr] = p
+	}
+	return peers
+}
+
+// FindOrConnect returns the peer registered under addr, dialing it
+// through net if it isn't already connected. It refuses to redial a
+// banned address.
+func (s *PeerSet) FindOrConnect(net Network, addr string) (Peer, error) {
+	if p, ok := s.Get(addr); ok {
+		return p, nil
+	}
+
+	if s.Banned(addr) {
+		return nil, fmt.Errorf("refusing to redial banned peer %s", addr)
+	}
+
+	p, err := net.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Add(addr, p)
+	return p, nil
+}
+
+// SendMsg enqueues fn to run against the peer at addr, on the priority
+// lane when priority is true. It drops the send rather than blocking
+// if that lane is full, so one stuck peer can't back up sends to
+// others. It reports whether fn was enqueued.
+func (s *PeerSet) SendMsg(addr string, priority bool, fn func(Peer)) bool {
+	s.mu.RLock()
+	q, ok := s.queues[addr]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	ch := q.normal
+	if priority {
+		ch = q.priority
+	}
+
+	select {
+	case ch <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// BroadcastMsg enqueues fn against every registered peer.
+func (s *PeerSet) BroadcastMsg(priority bool, fn func(Peer)) {
+	for _, addr := range s.List() {
+		s.SendMsg(addr, priority, fn)
+	}
+}
@@ -9,6 +9,13 @@ import (
 var errCommitteeNotSelected = errors.New("committee not selected yet")
 var errAddrNotInCommittee = errors.New("addr not in committee")
 
+// errStaleRound is returned by RecvRandBeaconSigShare when a share's
+// round no longer matches the beacon's current round. Gossip
+// rebroadcast routinely delivers shares after the round has already
+// moved on, so callers should drop these rather than treat them as
+// misbehavior.
+var errStaleRound = errors.New("stale or future RandBeaconSigShare round")
+
 // RandomBeacon is the round information.
 //
 // The random beacon, block proposal, block notarization advance to
@@ -27,6 +34,15 @@ type RandomBeacon struct {
 
 	curRoundShares map[Hash]*RandBeaconSigShare
 	sigHistory     []*RandBeaconSig
+
+	// external, when set, is mixed into rbRand/ntRand/bpRand
+	// derivation alongside the internal threshold signature, so a
+	// compromised majority of a single committee can no longer bias
+	// every future committee on its own. networks is the registry of
+	// drand public keys external's entries are verified against; it is
+	// only meaningful alongside external.
+	external ExternalBeacon
+	networks *BeaconNetworks
 }
 
 // NewRandomBeacon creates a new random beacon
@@ -50,6 +66,64 @@ func NewRandomBeacon(seed Rand, groups []*Group, cfg Config) *RandomBeacon {
 	}
 }
 
+// SetExternalBeacon configures the external randomness beacon (e.g.
+// drand) to mix into future committee derivations, and the registry of
+// drand public keys its entries are verified against. It is optional:
+// a RandomBeacon with no external beacon configured derives committees
+// from the internal threshold signature chain alone, as before.
+func (r *RandomBeacon) SetExternalBeacon(b ExternalBeacon, networks *BeaconNetworks) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.external = b
+	r.networks = networks
+}
+
+// ExternalConfigured reports whether an external beacon has been set
+// via SetExternalBeacon. Callers that buffer signatures and blocks
+// ahead of handing them to RecvRandBeaconSig use this to decide
+// whether they must also wait for the round's block, which is the
+// only place a verified external beacon entry is available.
+func (r *RandomBeacon) ExternalConfigured() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.external != nil
+}
+
+// VerifyBeaconEntries checks the external beacon entries attached to a
+// block against those of its parent, when an external beacon is
+// configured. It is a no-op, returning nil, if none is configured, so
+// chains that don't run one validate exactly as before.
+func (r *RandomBeacon) VerifyBeaconEntries(prevRound, curRound int, prevEntries, curEntries []BeaconEntry) error {
+	r.mu.Lock()
+	external, networks := r.external, r.networks
+	r.mu.Unlock()
+
+	if external == nil {
+		return nil
+	}
+
+	if len(prevEntries) == 0 || len(curEntries) == 0 {
+		return errors.New("random beacon: missing external beacon entries")
+	}
+	prevEntry := prevEntries[len(prevEntries)-1]
+
+	activate, forking := networks.ActivationAfter(prevRound)
+	forking = forking && activate <= curRound
+	if forking {
+		return VerifyBeaconFork(external, networks, prevRound, curRound, prevEntry, curEntries)
+	}
+
+	// Not a fork: curEntries must be exactly the one entry for
+	// curRound. Anything else (VerifyBeaconFork only checks the
+	// 2-entry fork shape, and only when forking is true) must be
+	// rejected here rather than silently accepted.
+	if len(curEntries) != 1 {
+		return fmt.Errorf("random beacon: round %d: expected 1 beacon entry, got %d", curRound, len(curEntries))
+	}
+
+	return external.VerifyEntry(curEntries[0], prevEntry)
+}
+
 // GetShare returns the randome beacon signature share of the current
 // round.
 func (r *RandomBeacon) GetShare(h Hash) *RandBeaconSigShare {
@@ -66,7 +140,7 @@ func (r *RandomBeacon) RecvRandBeaconSigShare(s *RandBeaconSigShare, groupID int
 	defer r.mu.Unlock()
 
 	if r.round() != s.Round {
-		return nil, fmt.Errorf("unexpected RandBeaconSigShare.Round: %d, expected: %d", s.Round, r.round())
+		return nil, fmt.Errorf("%w: got %d, expected %d", errStaleRound, s.Round, r.round())
 	}
 
 	if h := hash(r.sigHistory[s.Round-1].Sig); h != s.LastSigHash {
@@ -91,8 +165,15 @@ func (r *RandomBeacon) RecvRandBeaconSigShare(s *RandBeaconSigShare, groupID int
 	return nil, nil
 }
 
-// RecvRandBeaconSig adds the random beacon signature.
-func (r *RandomBeacon) RecvRandBeaconSig(s *RandBeaconSig) error {
+// RecvRandBeaconSig adds the random beacon signature, deriving the
+// next round's committees from it and, when an external beacon is
+// configured, entries: the verified BeaconEntries carried by the
+// round's Block. entries must be non-empty whenever an external beacon
+// is configured; passing the block's entries, rather than fetching
+// them here, is what lets every honest node derive byte-identical
+// committees regardless of how or when its own node-local beacon
+// client happened to observe the round.
+func (r *RandomBeacon) RecvRandBeaconSig(s *RandBeaconSig, entries []BeaconEntry) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -100,12 +181,33 @@ func (r *RandomBeacon) RecvRandBeaconSig(s *RandBeaconSig) error {
 		return fmt.Errorf("unexpected RandBeaconSig round: %d, expected: %d", s.Round, r.round())
 	}
 
-	r.deriveRand(hash(s.Sig))
+	if r.external != nil && len(entries) == 0 {
+		return fmt.Errorf("round %d: external beacon configured but no verified beacon entries supplied", s.Round)
+	}
+
+	r.deriveRand(r.mixExternal(s, entries))
 	r.curRoundShares = make(map[Hash]*RandBeaconSigShare)
 	r.sigHistory = append(r.sigHistory, s)
 	return nil
 }
 
+// mixExternal folds the round's verified external beacon entries, if
+// an external beacon is configured, into the internal signature before
+// it seeds the next committee derivation:
+// seed.Derive(append(internalSig, drandSig...)). entries is expected
+// to be the Block's already-verified BeaconEntries for this round, not
+// fetched here, so derivation never depends on a node-local network
+// call. If no external beacon is configured, derivation uses the
+// internal signature alone.
+func (r *RandomBeacon) mixExternal(s *RandBeaconSig, entries []BeaconEntry) Hash {
+	if r.external == nil {
+		return hash(s.Sig)
+	}
+
+	entry := entries[len(entries)-1]
+	return hash(append(append([]byte{}, s.Sig...), entry.Sig...))
+}
+
 func (r *RandomBeacon) round() int {
 	return len(r.sigHistory)
 }
@@ -0,0 +1,122 @@
+package consensus
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// scoreThreshold is how negative a peer's score may fall before it
+	// is evicted from the peer set.
+	scoreThreshold = -100
+	// banDuration is how long an evicted peer is refused a redial.
+	banDuration = 10 * time.Minute
+
+	scoreInvalidSig   = -20
+	scoreWrongRound   = -10
+	scoreUnknownGroup = -20
+	scoreUnknownRef   = -10
+	// scoreGood is credited for any useful contribution: the first
+	// valid share seen for a round, or having served sync data.
+	scoreGood = 1
+)
+
+// reputation tracks a per-peer score used to decide when a peer should
+// be evicted for misbehavior. It is embedded in PeerSet rather than
+// kept as a free-standing type, since every scoring decision needs to
+// be followed by evicting the peer from the set and notifying onEvict.
+// It guards its maps with its own mutex, separate from PeerSet.mu, so
+// it can be called from code paths that don't otherwise touch
+// PeerSet's peer map.
+type reputation struct {
+	mu    sync.Mutex
+	score map[string]int
+	ban   map[string]time.Time
+}
+
+func newReputation() reputation {
+	return reputation{
+		score: make(map[string]int),
+		ban:   make(map[string]time.Time),
+	}
+}
+
+// MarkGood records a useful contribution from the peer at addr, such as
+// the first valid share seen for a round or having served sync data.
+func (s *PeerSet) MarkGood(addr string) {
+	s.reputation.mu.Lock()
+	defer s.reputation.mu.Unlock()
+
+	s.score[addr] += scoreGood
+}
+
+// StopForError penalizes the peer at addr for the given validation
+// failure, and evicts it once its score crosses scoreThreshold: the
+// peer is removed from the set, onEvict is notified so owners such as
+// the block pool can reassign its in-flight requests, and its address
+// is banned from redialing for banDuration.
+func (s *PeerSet) StopForError(addr string, err error) {
+	s.reputation.mu.Lock()
+	defer s.reputation.mu.Unlock()
+
+	s.score[addr] += scoreDelta(err)
+	log.Printf("peer %s: %v (score: %d)\n", addr, err, s.score[addr])
+
+	if s.score[addr] > scoreThreshold {
+		return
+	}
+
+	s.evict(addr)
+}
+
+// scoreDelta maps a validation error to the score penalty it incurs.
+// An error outside this set isn't known to indicate misbehavior, so it
+// incurs no penalty rather than being guessed at.
+func scoreDelta(err error) int {
+	switch err {
+	case errInvalidSig:
+		return scoreInvalidSig
+	case errWrongRound:
+		return scoreWrongRound
+	case errUnknownGroup:
+		return scoreUnknownGroup
+	case errUnknownRef:
+		return scoreUnknownRef
+	default:
+		return 0
+	}
+}
+
+// evict removes addr from the peer set and bans it from redialing for
+// a cooldown period. Must be called with s.reputation.mu held.
+func (s *PeerSet) evict(addr string) {
+	log.Printf("evicting peer %s: score %d crossed threshold %d\n", addr, s.score[addr], scoreThreshold)
+
+	delete(s.score, addr)
+	s.ban[addr] = time.Now().Add(banDuration)
+
+	if s.onEvict != nil {
+		s.onEvict(addr)
+	}
+	s.Remove(addr)
+}
+
+// Banned reports whether addr is still serving out its cooldown after
+// an eviction.
+func (s *PeerSet) Banned(addr string) bool {
+	s.reputation.mu.Lock()
+	defer s.reputation.mu.Unlock()
+
+	until, ok := s.ban[addr]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(until) {
+		delete(s.ban, addr)
+		return false
+	}
+
+	return true
+}